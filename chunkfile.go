@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Jason T. Lenz.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package chunkio
+
+import (
+	"bytes"
+	"io"
+)
+
+// ChunkFile provides random access by number to the chunks of a stream stored
+// in an io.ReaderAt, such as an os.File, using the index of the stream built by
+// Reader.BuildIndex.  This turns a file of chunks ended by a key into a record
+// store that can be read in any order without scanning it.
+type ChunkFile struct {
+	rd   io.ReaderAt // Source of the stream
+	size int64       // Size of the stream
+	idx  []int64     // Offset of the first byte of each chunk
+	key  []byte      // key that delineates end of chunk
+}
+
+// NewChunkFile creates a ChunkFile for the size bytes of the stream in rd, with
+// the chunk offsets idx returned by Reader.BuildIndex for the same stream and
+// key.
+func NewChunkFile(rd io.ReaderAt, size int64, idx []int64, key []byte) *ChunkFile {
+	return &ChunkFile{rd: rd, size: size, idx: idx, key: key}
+}
+
+// Len returns the number of chunks in the index.
+func (f *ChunkFile) Len() int {
+	return len(f.idx)
+}
+
+// Chunk returns the data of chunk n, counting from zero, without the key.  The
+// chunk is read from the offset of chunk n in the index up to the offset of
+// the next chunk, or the end of the stream for the last chunk, whose key is
+// only removed if the stream ends with it.  ErrNoChunk is returned if n is not
+// in the index, and ErrKeyNotFound if a chunk other than the last does not end
+// with the key, which means the index does not match the stream and key.
+func (f *ChunkFile) Chunk(n int) ([]byte, error) {
+	if n < 0 || n >= len(f.idx) {
+		return nil, ErrNoChunk
+	}
+	end := f.size
+	if n+1 < len(f.idx) {
+		end = f.idx[n+1]
+	}
+	if end < f.idx[n] {
+		return nil, ErrNoChunk
+	}
+	b := make([]byte, end-f.idx[n])
+	if m, err := f.rd.ReadAt(b, f.idx[n]); m < len(b) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if bytes.HasSuffix(b, f.key) {
+		return b[:len(b)-len(f.key)], nil
+	}
+	if n+1 < len(f.idx) {
+		return nil, ErrKeyNotFound
+	}
+	return b, nil
+}
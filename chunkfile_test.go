@@ -0,0 +1,50 @@
+// Copyright (c) 2019 Jason T. Lenz.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package chunkio_test
+
+import (
+	"git.lenzplace.org/lenzj/chunkio"
+	"strings"
+	"testing"
+)
+
+func TestShortChunkFile(t *testing.T) {
+	cases := []struct {
+		desc string
+		in   string
+		out  []string
+	}{
+		{"Trailing key", "a;;bc;;;;def;;", []string{"a", "bc", "", "def"}},
+		{"No trailing key", "a;;bc;;;;def", []string{"a", "bc", "", "def"}},
+		{"Partial trailing key", "a;;b;", []string{"a", "b;"}},
+		{"Empty stream", "", nil},
+	}
+	for _, c := range cases {
+		r := chunkio.NewReader(strings.NewReader(c.in))
+		r.SetKey([]byte(";;"))
+		idx, err := r.BuildIndex()
+		if err != nil {
+			t.Fatalf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, nil, err)
+		}
+		f := chunkio.NewChunkFile(strings.NewReader(c.in), int64(len(c.in)), idx, []byte(";;"))
+		if f.Len() != len(c.out) {
+			t.Errorf("Case %q. Expected %d chunks, got %d", c.desc, len(c.out), f.Len())
+		}
+		// Read the chunks backward to check they do not depend on each other
+		for i := len(c.out) - 1; i >= 0; i-- {
+			out, err := f.Chunk(i)
+			if err != nil || string(out) != c.out[i] {
+				t.Errorf("Case %q. Expected chunk %d %q, got %q (err %v)", c.desc, i, c.out[i], out, err)
+			}
+		}
+		if _, err := f.Chunk(len(c.out)); err != chunkio.ErrNoChunk {
+			t.Errorf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, chunkio.ErrNoChunk, err)
+		}
+	}
+	f := chunkio.NewChunkFile(strings.NewReader("abc;;d"), 6, []int64{0, 2}, []byte(";;"))
+	if _, err := f.Chunk(0); err != chunkio.ErrKeyNotFound {
+		t.Errorf("Chunk. Expected error=\"%v\", got \"%v\"", chunkio.ErrKeyNotFound, err)
+	}
+}
@@ -12,172 +12,3330 @@ package chunkio
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"iter"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 const (
 	minKeyLength = 1
+	minBufAdd    = 16   // Smallest read ahead size accepted by NewReaderSize
+	minBMHKey    = 9    // Shortest key searched with Boyer-Moore-Horspool
 	bufAdd       = 4096 // buffAdd plus key length = buffer size
+	escXor       = 0x20 // Mask applied to the byte following an escape sequence
+
+	maxConsecutiveEmptyReads = 100 // Empty reads tolerated before io.ErrNoProgress
+)
+
+var (
+	ErrInvalidKey    = errors.New("chunkio: invalid key definition")
+	ErrBufferFull    = errors.New("chunkio: buffer full")
+	ErrNegativeCount = errors.New("chunkio: negative count")
+
+	ErrInvalidUnreadByte  = errors.New("chunkio: invalid use of UnreadByte")
+	ErrInvalidUnreadChunk = errors.New("chunkio: invalid use of UnreadChunk")
+	ErrChunkTooLarge      = errors.New("chunkio: chunk too large")
+	ErrKeyFunc            = errors.New("chunkio: key function returned invalid result")
+	ErrClosed             = errors.New("chunkio: reader closed")
+	ErrInternal           = errors.New("chunkio: internal error")
+	ErrNotSeekable        = errors.New("chunkio: underlying reader is not seekable")
+	ErrNoChunk            = errors.New("chunkio: chunk does not exist")
+	ErrMaxTotalExceeded   = errors.New("chunkio: maximum total size exceeded")
+	ErrInvalidEscape      = errors.New("chunkio: invalid escape sequence")
+	ErrInvalidDecoder     = errors.New("chunkio: invalid chunk decoder")
+
+	// ErrKeyNotFound is returned when the stream ends before the key.  It is
+	// io.ErrUnexpectedEOF, which was returned in this case before, so that
+	// errors compared with == against either value keep matching.
+	ErrKeyNotFound = io.ErrUnexpectedEOF
 )
 
-var ErrInvalidKey = errors.New("chunkio: invalid key definition")
+// KeyFunc is the signature of the function used by SetKeyFunc to locate the
+// key in the buffered data.
+type KeyFunc func(data []byte, atEOF bool) (advance int, keylen int)
+
+// KeySelector is the signature of the function used by SetKeySelector to choose
+// the key of a chunk from its first bytes.
+type KeySelector func(prefix []byte) []byte
+
+// Decoder is the signature of the function used by SetChunkDecoder to decode
+// chunk data, such as the Decode method of base64.Encoding or hex.Decode.
+type Decoder func(dst, src []byte) (int, error)
+
+// Stats is a snapshot of the progress of a Reader, as returned by Stats.
+type Stats struct {
+	BytesRead     int64 // Bytes consumed from the stream, as returned by Offset
+	ChunksRead    int   // Chunks ended by a key, as returned by ChunkCount
+	KeyFound      bool  // Whether the last chunk ended with a key, as returned by Complete
+	BufferedBytes int   // Bytes in the internal buffer, as returned by Buffered
+}
+
+// ChunkioStats summarizes the chunks of a whole stream, as returned by Analyze.
+// Sizes are the number of bytes of chunk data, without the keys.
+type ChunkioStats struct {
+	Count           int   // Number of chunks
+	TotalBytes      int64 // Total size of the chunks
+	MinSize         int64 // Size of the smallest chunk
+	MaxSize         int64 // Size of the largest chunk
+	FinalTerminated bool  // Whether the last chunk ended with a key
+}
+
+// MeanSize returns the mean size of the chunks, or 0 if there are none.
+func (s ChunkioStats) MeanSize() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.TotalBytes) / float64(s.Count)
+}
+
+// readResult holds the outcome of a read from the underlying Reader done in a
+// goroutine by ReadContext.
+type readResult struct {
+	data []byte
+	err  error
+}
 
 // Reader implements chunkio functionality wrapped around an io.Reader object
 type Reader struct {
-	rd      io.Reader    // Underlying Reader
-	key     []byte       // key that delineates end of chunk
-	buf     bytes.Buffer // A buffer to provide "read ahead" ability
-	bufSize int          // The target buffer size
-	err     error        // Current error state of chunkio Reader
-	ierr    error        // Current error state of underlying Reader
-	scan    int          // Number of bytes in buffer that have already been scanned for key
-	found   bool         // True if key exists in buffer. Position is in scan in that case
-}
-
-// NewReader creates a new chunk reader.
-func NewReader(rd io.Reader) *Reader {
+	rd        io.Reader        // Underlying Reader
+	key       []byte           // key that delineates end of chunk
+	keys      [][]byte         // Set of keys, any of which delineates end of chunk
+	skips     []*[256]int      // Boyer-Moore-Horspool skip tables of long keys
+	maxKey    int              // Length of the longest key in keys
+	split     KeyFunc          // Function that locates the key, if any
+	order     binary.ByteOrder // Byte order of the length prefix of frames
+	prefix    int              // Length of the length prefix of frames; 0 if keys are used
+	frame     int64            // Length of the current frame; -1 if its prefix is not read yet
+	frameSkip int64            // Bytes of an earlier frame still to be discarded
+	match     []byte           // The key found in the buffer
+	hit       int              // Index in keys of the key in match; -1 if none
+	matched   int              // Index in keys of the key that ended the chunk; -1 if none
+	keyOff    int64            // Offset in the stream of the key that ended the last chunk; -1 if none
+	keep      bool             // True if key bytes are returned as part of the chunk
+	skipEmpty bool             // True if empty chunks are skipped
+	skipLead  bool             // True if a key at the start of the stream is skipped
+	eagerEOF  bool             // True if the last bytes of a chunk are returned with io.EOF
+	eofTerm   bool             // True if the end of the stream ends a chunk like a key
+	fold      bool             // True if keys are matched ignoring ASCII case
+	wild      int              // Byte of the key matching any byte, see SetKeyPattern; -1 if none
+	anyByte   string           // Bytes each ending the chunk, see SetKeyAnyByte; "" if none
+	start     []byte           // Marker that starts each chunk, see SetBracket; nil if none
+	inside    bool             // True if the start marker of the current chunk has been read
+	selector  KeySelector      // Function choosing the key of each chunk, if any
+	window    int              // Number of bytes passed to selector
+	selected  bool             // True if selector chose the key of the current chunk
+	esc       []byte           // Escape sequence decoded from chunk data; nil if none
+	transform func(p []byte)   // Function rewriting chunk data before delivery, if any
+	decode    Decoder          // Function decoding chunk data, if any
+	group     int              // Number of encoded bytes decoded as a unit
+	decoded   []byte           // Decoded chunk data not yet delivered
+	dtmp      []byte           // Scratch space for decoded data
+	drop      int              // Number of key bytes to discard at end of chunk
+	buf       bytes.Buffer     // A buffer to provide "read ahead" ability
+	tmp       []byte           // Scratch space for reads from the underlying Reader
+	ctx       context.Context  // Context of the active ReadContext call, if any
+	pending   chan readResult  // Read from the underlying Reader still in progress
+	tee       io.Writer        // Writer receiving a copy of all data read from rd
+	marker    []byte           // Sequence reported to markFn when read from rd, if any
+	markFn    func(int64)      // Function called with the offset of each marker
+	mtail     []byte           // End of the data read that may start a marker
+	trace     io.Writer        // Writer receiving a line describing each read, if any
+	bufAdd    int              // Read ahead size (bufAdd plus key length = bufSize)
+	bufSize   int              // The target buffer size
+	err       error            // Current error state of chunkio Reader
+	ierr      error            // Current error state of underlying Reader
+	terr      error            // Error writing to tee, if any
+	scan      int              // Number of bytes in buffer that have already been scanned for key
+	found     bool             // True if key exists in buffer. Position is in scan in that case
+	last      int              // Last byte read by ReadByte for UnreadByte; -1 if invalid
+	lastBuf   bool             // True if last can be stepped back in buf
+	off       int64            // Number of bytes consumed from the underlying stream
+	chunks    int              // Number of chunks ended by a key
+	size      int              // Number of bytes delivered from the current chunk
+	maxSize   int              // Maximum number of bytes in a chunk; 0 if unlimited
+	headSize  int              // Number of bytes delivered from each chunk; 0 if unlimited
+	maxPeek   int              // Size up to which PeekChunk grows the buffer; 0 if not grown
+	minSize   int              // Chunks shorter than minSize bytes are skipped
+	maxTotal  int64            // Maximum number of bytes consumed from the stream; 0 if unlimited
+	checked   int64            // Offset in the stream before which no key can start
+	complete  bool             // True if the last chunk ended with a key
+	hash      hash.Hash        // Hash of the data of the current chunk, if any
+	sum       []byte           // Sum of hash for the last chunk that ended
+	unhashed  int              // Number of unread bytes already added to hash
+	retain    bool             // True if the data of each chunk is kept, see SetRetainChunks
+	kept      []byte           // Data delivered from the current chunk if retain is set
+	lastChunk []byte           // Data of the last chunk that ended if retain is set
+	mu        *sync.Mutex      // Guards all methods if the Reader is synchronized
+	ioDone    *sync.Cond       // Signaled when reading ends, on mu
+	reading   bool             // True while mu is released to read from rd
+	empty     int              // Number of consecutive empty reads of rd
+}
+
+// NewReader creates a new chunk reader, configured by the options given, if
+// any, in order.  The setters of the Reader remain available to change the
+// configuration later.
+func NewReader(rd io.Reader, opts ...Option) *Reader {
+	c := NewReaderSize(rd, bufAdd)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Option configures a Reader created by NewReader.
+type Option func(*Reader)
+
+// WithKey sets the key like SetKey.  If key is invalid, reading returns
+// ErrInvalidKey.
+func WithKey(key []byte) Option {
+	return func(c *Reader) {
+		if err := c.setKey(key); err != nil {
+			c.err = err
+		}
+	}
+}
+
+// WithBufferSize sets the read ahead size like NewReaderSize.
+func WithBufferSize(size int) Option {
+	return func(c *Reader) {
+		if size < minBufAdd {
+			size = minBufAdd
+		}
+		c.bufAdd = size
+		c.bufSize = size + c.maxKey
+	}
+}
+
+// WithMaxChunkSize limits the size of chunks like SetMaxChunkSize.
+func WithMaxChunkSize(n int) Option {
+	return func(c *Reader) {
+		c.maxSize = n
+	}
+}
+
+// NewReaderSize creates a new chunk reader whose read ahead buffer holds size
+// bytes plus the length of the key.  Since the key length is added on top of
+// size, the key always fits within the buffer.  A size smaller than 16 bytes
+// is clamped to 16.
+func NewReaderSize(rd io.Reader, size int) *Reader {
+	if size < minBufAdd {
+		size = minBufAdd
+	}
 	return &Reader{
 		rd:      rd,
 		key:     nil,
 		buf:     bytes.Buffer{},
-		bufSize: 0,
+		bufAdd:  size,
+		bufSize: size,
 		err:     nil,
 		ierr:    nil,
 		scan:    0,
 		found:   false,
+		last:    -1,
+		wild:    -1,
+		hit:     -1,
+		matched: -1,
+		keyOff:  -1,
+	}
+}
+
+// NewMultiReader creates a new chunk reader over the concatenation of readers,
+// with chunks ended by key.  The readers are read in sequence as by
+// io.MultiReader, and a key split across two of them is found like any other.
+// If key is invalid, reading returns ErrInvalidKey.
+func NewMultiReader(key []byte, readers ...io.Reader) *Reader {
+	c := NewReader(io.MultiReader(readers...))
+	if err := c.SetKey(key); err != nil {
+		c.err = err
 	}
+	return c
 }
 
-// GetKey returns the key for the current active chunkio stream.
+// GetKey returns the key for the current active chunkio stream.  If several
+// keys were set with SetKeys the first one is returned.
 func (c *Reader) GetKey() []byte {
+	defer c.lockState()()
 	return c.key
 }
 
 // GetErr returns the error status for the current active chunkio stream.
 func (c *Reader) GetErr() error {
+	defer c.lockState()()
 	return c.err
 }
 
+// MatchedKey returns the key that ended the most recent chunk, or nil if the
+// chunk ended because the stream ended without a key.  This is mostly useful
+// when several keys were set with SetKeys.  The result remains valid until the
+// first Read after Reset.  With SetKeepKey it is also the suffix of the chunk
+// read, so the data before the key is the chunk without its last
+// len(MatchedKey()) bytes.
+func (c *Reader) MatchedKey() []byte {
+	defer c.lockState()()
+	return c.match
+}
+
+// MatchedIndex returns the index of the key that ended the current chunk in the
+// keys set by SetKeys or SetKeyStrings, which makes it easy to act on which key
+// was found.  It returns -1 until the key is reached, after Reset, when the
+// stream ended without a key, and in length prefixed mode.  Keys set by
+// SetKeyRegexp or SetKeyFunc have the index 0.
+func (c *Reader) MatchedIndex() int {
+	defer c.lockState()()
+	return c.matched
+}
+
+// KeyOffset returns the offset in the stream at which the key that ended the
+// most recent chunk starts, and true if the chunk ended with a key.  Together
+// with Offset this gives the exact position of each key without a separate
+// pass over the stream, whether or not the key is kept with SetKeepKey.  It
+// returns -1 and false before the first chunk ends, if the chunk ended because
+// the stream ended, and in length prefixed mode.  The result is kept after
+// Reset until the next chunk ends.
+func (c *Reader) KeyOffset() (int64, bool) {
+	defer c.lockState()()
+	return c.keyOff, c.keyOff >= 0
+}
+
+// Offset returns the number of bytes consumed from the underlying stream, which
+// is the data delivered to the caller plus any keys discarded.  It is the
+// position in the original stream of the next byte to be read.
+func (c *Reader) Offset() int64 {
+	defer c.lockState()()
+	return c.off
+}
+
+// Complete reports whether the most recently ended chunk was ended by a key,
+// as opposed to the stream ending before the key was found.  Once the stream
+// ends right after a key, the next read returns no data with ErrKeyNotFound
+// without ending a chunk, so Complete, like ChunkSum and LastChunk, still
+// reports the chunk ended by that key.
+func (c *Reader) Complete() bool {
+	defer c.lockState()()
+	return c.complete
+}
+
+// ChunkCount returns the number of chunks that have ended with a key.  Chunks
+// ended by the end of the stream are not counted.
+func (c *Reader) ChunkCount() int {
+	defer c.lockState()()
+	return c.chunks
+}
+
+// BufSize returns the size of the read ahead buffer currently in use, which is
+// the read ahead size plus the length of the key.  If no key has been set only
+// the read ahead size is returned.
+func (c *Reader) BufSize() int {
+	defer c.lockState()()
+	return c.bufSize
+}
+
+// Buffered returns the number of bytes that can be read from the internal
+// buffer without reading from the underlying Reader.  This includes bytes
+// beyond the end of the current chunk.
+func (c *Reader) Buffered() int {
+	defer c.lockState()()
+	return c.buf.Len()
+}
+
+// Prefetch fills the internal buffer from the underlying Reader without
+// consuming any data, so the next read finds it already buffered.  This can be
+// used to separate the cost of reading from that of parsing.  It returns nil
+// if the buffer is full, otherwise the error that ended reading, which is
+// io.EOF at the end of the underlying Reader.  A closed Reader returns
+// ErrClosed.
+func (c *Reader) Prefetch() error {
+	defer c.lock()()
+	if c.err == ErrClosed {
+		return ErrClosed
+	}
+	if err := c.bufFill(); err != nil {
+		return err
+	}
+	if c.buf.Len() < c.bufSize {
+		return c.ierr
+	}
+	return nil
+}
+
+// Drained reports whether the underlying Reader has returned io.EOF and the
+// buffered data following the current chunk is too short to hold a key, so no
+// chunk after the current one can end with a key.  Trailing data without a key
+// may still remain, see Buffered.  Only data read so far is considered, so
+// Drained is false until a read hits the end of the underlying Reader.
+func (c *Reader) Drained() bool {
+	defer c.lock()()
+	if c.ierr != io.EOF {
+		return false
+	}
+	rest := c.buf.Len()
+	if c.found {
+		rest -= c.scan + c.drop
+	}
+	min := 1
+	switch {
+	case c.prefix > 0:
+		min = c.prefix
+	case c.keys != nil:
+		min = len(c.keys[0])
+		for _, key := range c.keys {
+			if len(key) < min {
+				min = len(key)
+			}
+		}
+	}
+	return rest < min
+}
+
+// Residual returns an io.Reader over the rest of the stream, starting with the
+// data in the internal buffer and continuing with the underlying Reader.  Keys
+// are not searched for, so it returns the same data as setting the key to nil
+// and reading, but leaves the keys in place.  This is typically used after the
+// last chunk to get the trailing data.  Reading from it discards the state of
+// the current chunk.
+func (c *Reader) Residual() io.Reader {
+	return residual{c}
+}
+
+// Passthrough returns an io.Reader over the rest of the stream including the
+// keys, so a delimited stream can be copied with its keys intact.  Unlike
+// Residual, keys are still searched for: each chunk is read as with
+// SetKeepKey, and the Reader is Reset at each key, so chunks are counted, the
+// chunk hash and retained chunks are updated, and the transform of
+// SetTransform edits chunk data but never the keys.  Data after the last key
+// is returned followed by io.EOF.  Chunks skipped by SetSkipEmpty or
+// SetMinChunkSize and data outside the regions of SetBracket are left out.
+func (c *Reader) Passthrough() io.Reader {
+	return passthrough{c}
+}
+
+// Stats returns the values of Offset, ChunkCount, Complete and Buffered at once.
+func (c *Reader) Stats() Stats {
+	defer c.lockState()()
+	return Stats{
+		BytesRead:     c.off,
+		ChunksRead:    c.chunks,
+		KeyFound:      c.complete,
+		BufferedBytes: c.buf.Len(),
+	}
+}
+
+// Underlying returns the io.Reader wrapped by the Reader.  Data already read
+// ahead into the internal buffer, see Buffered, is not available from it.
+func (c *Reader) Underlying() io.Reader {
+	defer c.lockState()()
+	return c.rd
+}
+
+// ValidKey returns ErrInvalidKey if key cannot be used as a key, that is if it
+// is nil or shorter than the minimum key length, and nil otherwise.  It applies
+// the same check as SetKey and SetKeys without needing a Reader, so keys from
+// a configuration can be validated up front.  Note that SetKey also accepts a
+// nil key, which clears the key.
+func ValidKey(key []byte) error {
+	if len(key) < minKeyLength {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
 // SetKey updates the search key.  The search key can also be cleared by
-// providing a nil key.
+// providing a nil key.  Data already in the internal buffer is kept, so after
+// clearing the key the rest of the stream, including data read before the
+// underlying Reader failed, is delivered before its error is returned.  An
+// error ending the current chunk, such as io.EOF, is only cleared by Reset.
 func (c *Reader) SetKey(key []byte) error {
+	defer c.lock()()
+	return c.setKey(key)
+}
+
+// setKey is SetKey for a Reader that is already locked.
+func (c *Reader) setKey(key []byte) error {
 	if key == nil {
 		c.key = key
+		c.keys = nil
+		c.anyByte = ""
+		c.skips = nil
+		c.split = nil
+		c.prefix = 0
+		c.wild = -1
+		c.start = nil
+		c.selector = nil
+		c.maxKey = 0
+		c.last = -1
+		c.bufSize = c.bufAdd
+		c.scan = 0
+		c.found = false
 		return nil
 	}
-	if len(key) < minKeyLength {
+	return c.setKeys(key)
+}
+
+// SetKeyRune sets the UTF-8 encoding of r as the key, which is then returned by
+// GetKey.  ErrInvalidKey is returned if r is utf8.RuneError or not a valid
+// rune.
+func (c *Reader) SetKeyRune(r rune) error {
+	if r == utf8.RuneError || !utf8.ValidRune(r) {
 		return ErrInvalidKey
 	}
-	c.key = key
-	c.bufSize = bufAdd + len(c.key)
-	if c.buf.Cap() < c.bufSize {
-		c.buf.Grow(c.bufSize - c.buf.Cap())
+	return c.SetKey(utf8.AppendRune(nil, r))
+}
+
+// SetKeys updates the search keys.  The chunk ends at whichever key appears
+// first in the stream.  If two keys match at the same position, the one listed
+// first wins.  Keys may be longer than the read ahead size, as the buffer is
+// grown by the length of the longest key so that it always holds the read
+// ahead size on top of a partial key.  The only bound on key length is the
+// memory taken by that buffer.
+func (c *Reader) SetKeys(keys ...[]byte) error {
+	defer c.lock()()
+	return c.setKeys(keys...)
+}
+
+// setKeys is SetKeys for a Reader that is already locked.
+func (c *Reader) setKeys(keys ...[]byte) error {
+	if len(keys) == 0 {
+		return ErrInvalidKey
 	}
-	c.scan = 0
+	for _, key := range keys {
+		if err := ValidKey(key); err != nil {
+			return err
+		}
+	}
+	c.key = keys[0]
+	c.keys = keys
+	c.anyByte = ""
+	c.wild = -1
+	c.start = nil
+	c.selector = nil
+	c.skips = make([]*[256]int, len(keys))
+	for i, key := range keys {
+		if len(key) >= minBMHKey {
+			c.skips[i] = skipTable(key)
+		}
+	}
+	c.split = nil
+	c.prefix = 0
+	c.setMaxKey(c.maxKeys())
 	return nil
 }
 
-// Reset puts the chunkio stream back into a readable state.  This can be used
-// when the end of a chunk is reached to enable reading the next chunk.
-func (c *Reader) Reset() {
-	if c.buf.Len() == 0 && c.ierr != nil {
-		c.err = io.ErrUnexpectedEOF
-	} else {
-		c.err = nil
+// SetKeyPattern sets pattern as the key, where each byte equal to wildcard
+// matches any byte of the stream.  This suits markers containing a variable
+// field, such as a version number.  The whole length of pattern is discarded
+// at the end of a chunk, and the bytes actually matched are reported by
+// MatchedKey.  Since every occurrence of wildcard in pattern is a wildcard, a
+// marker that must match the wildcard value itself at some position cannot be
+// expressed, and any byte is accepted there instead; choose a wildcard value
+// that does not appear at a fixed position of the marker.  A pattern made only
+// of wildcards is invalid.
+func (c *Reader) SetKeyPattern(pattern []byte, wildcard byte) error {
+	defer c.lock()()
+	if len(bytes.Trim(pattern, string([]byte{wildcard}))) == 0 {
+		return ErrInvalidKey
 	}
-	c.scan = 0
-	c.found = false
+	if err := c.setKeys(pattern); err != nil {
+		return err
+	}
+	c.wild = int(wildcard)
+	c.setMaxKey(len(pattern))
+	return nil
 }
 
-func (c *Reader) readScanned(p []byte) (int, error) {
-	var n int
+// SetKeyAnyByte ends each chunk at the first byte of the stream that is in set,
+// as for fields separated by any of a comma, a tab or a semicolon.  The byte is
+// discarded like a key, unless SetKeepKey is set, and reported by MatchedKey,
+// while MatchedIndex returns its index in set.  This is equivalent to SetKeys
+// with each byte of set as a key, but set is searched for in a single pass if
+// it only holds ASCII bytes.  ErrInvalidKey is returned if set is empty.
+func (c *Reader) SetKeyAnyByte(set []byte) error {
+	defer c.lock()()
+	keys := make([][]byte, len(set))
+	for i := range set {
+		keys[i] = set[i : i+1 : i+1]
+	}
+	if err := c.setKeys(keys...); err != nil {
+		return err
+	}
+	for _, b := range set {
+		if b >= utf8.RuneSelf {
+			// bytes.IndexAny would take the set as UTF-8
+			return nil
+		}
+	}
+	c.anyByte = string(set)
+	return nil
+}
 
-	if c.scan > len(p) {
-		n, _ = c.buf.Read(p)
-	} else {
-		n, _ = c.buf.Read(p[:c.scan])
+// SetKeyStrings is like SetKeys but takes the keys as strings.
+func (c *Reader) SetKeyStrings(keys ...string) error {
+	b := make([][]byte, len(keys))
+	for i, key := range keys {
+		b[i] = []byte(key)
 	}
-	c.scan = c.scan - n
-	if n > 0 && c.scan >= 0 {
-		return n, nil
-	} else {
-		return 0, io.ErrUnexpectedEOF
+	return c.SetKeys(b...)
+}
+
+// SetKeySelector chooses the key of each chunk when the chunk starts, for
+// formats where the first bytes of a record tell how it ends.  fn is passed up
+// to window bytes from the start of the chunk, fewer only at the end of the
+// stream, and returns the key of the chunk.  These bytes are part of the
+// chunk and are delivered as usual.  fn is called again for the next chunk
+// after Reset.  A key shorter than one byte makes reading fail with
+// ErrInvalidKey.  The window must be between 1 and the read ahead size,
+// otherwise ErrInvalidKey is returned.  A nil fn clears the key like
+// SetKey(nil), and setting a key by other means ends this mode.
+func (c *Reader) SetKeySelector(window int, fn KeySelector) error {
+	defer c.lock()()
+	if fn == nil {
+		return c.setKey(nil)
+	}
+	if window < 1 || window > c.bufAdd {
+		return ErrInvalidKey
+	}
+	if err := c.setKey(nil); err != nil {
+		return err
+	}
+	c.selector = fn
+	c.anyByte = ""
+	c.window = window
+	c.selected = false
+	return nil
+}
+
+// selectKey sets the key of the current chunk chosen by the function set by
+// SetKeySelector.
+func (c *Reader) selectKey() error {
+	if err := c.bufFill(); err != nil {
+		return err
+	}
+	if c.buf.Len() == 0 && c.ierr != nil {
+		return c.truncated()
+	}
+	b := c.buf.Bytes()
+	key := c.selector(b[:min(c.window, len(b))])
+	if err := ValidKey(key); err != nil {
+		c.err = err
+		return c.err
+	}
+	// The key may be part of the buffer
+	key = append([]byte(nil), key...)
+	c.key = key
+	c.keys = [][]byte{key}
+	c.skips = []*[256]int{nil}
+	if len(key) >= minBMHKey {
+		c.skips[0] = skipTable(key)
 	}
+	c.maxKey = len(key)
+	c.bufSize = c.bufAdd + c.maxKey
+	c.checked = c.off
+	c.selected = true
+	return nil
 }
 
-func (c *Reader) readEOF() (int, error) {
-	// Discard key from input stream
-	r := make([]byte, len(c.key))
-	n, err := c.buf.Read(r)
-	if n != len(c.key) || err != nil {
-		panic("Error: Unexpected error in chunkio.readEOF()")
+// SetBracket makes chunks the regions of the stream enclosed by the markers
+// start and end, such as "<<<" and ">>>".  Data before start is discarded
+// along with start, then the chunk is delivered until end, which is treated as
+// the key.  Reset moves on to the next region, discarding any data up to its
+// start marker, including the unread data of the current region.  A stream
+// ending without another start marker ends with an empty chunk and
+// ErrKeyNotFound, so Chunks stops there.  Setting a key with SetKey or SetKeys
+// ends this mode.
+func (c *Reader) SetBracket(start, end []byte) error {
+	defer c.lock()()
+	if err := ValidKey(start); err != nil {
+		return err
 	}
-	// Set / return EOF
-	c.err = io.EOF
-	return 0, io.EOF
+	if err := c.setKeys(end); err != nil {
+		return err
+	}
+	c.start = start
+	c.inside = false
+	c.setMaxKey(max(len(start), len(end)))
+	return nil
 }
 
-func (c *Reader) bufFill() error {
-	for c.buf.Len() < c.bufSize {
-		t := make([]byte, c.bufSize-c.buf.Len())
-		n, err := c.rd.Read(t)
-		c.buf.Write(t[:n])
-		if err != nil {
+// bracket reports whether chunks are enclosed by the markers of SetBracket.
+func (c *Reader) bracket() bool {
+	return c.start != nil && c.split == nil && c.prefix == 0
+}
+
+// seekStart discards the data up to and including the start marker of the next
+// region for SetBracket.
+func (c *Reader) seekStart() error {
+	for {
+		if err := c.bufFill(); err != nil {
 			return err
 		}
+		b := c.buf.Bytes()
+		i := bytes.Index(b, c.start)
+		if c.fold {
+			i = indexFold(b, c.start)
+		}
+		n := len(b) - len(c.start) + 1
+		switch {
+		case i >= 0:
+			n = i + len(c.start)
+			c.inside = true
+		case c.ierr != nil:
+			n = len(b)
+		}
+		c.buf.Next(n)
+		c.off += int64(n)
+		if c.inside {
+			return nil
+		}
+		if c.ierr != nil {
+			// Reached input EOF w/o start marker
+			return c.truncated()
+		}
 	}
-	return nil
 }
 
-// Read implements the standard Reader interface allowing chunkio to be used
-// anywhere a standard Reader can be used.  Read puts data into p.  It returns
-// the number of bytes read into p.  The bytes are taken from at most one read
-// on the underlying Reader, hence n may be less than len(p).  When the key is
-// reached (EOF for the stream chunk), the count will be zero and err will be
-// io.EOF.  If the key has been set to nil, the Read function performs exactly
-// like the underlying stream Read function (no key scanning).
-func (c *Reader) Read(p []byte) (int, error) {
-	if len(p) == 0 {
-		return 0, nil
+// SetLineMode ends each chunk at the next line ending, which is either "\n" or
+// "\r\n", like bufio.ScanLines.  The line ending is discarded as a key, so a
+// carriage return is only dropped when it comes right before the newline.
+func (c *Reader) SetLineMode() {
+	c.SetKeys([]byte("\r\n"), []byte("\n"))
+}
+
+// SetKeyRegexp ends chunks at the earliest match of re instead of a fixed key.
+// The matched bytes are discarded like a key and are reported by MatchedKey.
+// Matches are only detected if they are no longer than the read ahead size,
+// and a match reaching the end of the buffered data is extended with more
+// data before being accepted.  A nil re clears the key like SetKey(nil).  A
+// regular expression that can match the empty string anywhere in the data,
+// such as `;|\b`, is invalid.
+func (c *Reader) SetKeyRegexp(re *regexp.Regexp) error {
+	defer c.lock()()
+	if re == nil {
+		return c.setKey(nil)
 	}
-	if c.err != nil {
-		return 0, c.err
+	if matchesEmpty(re) {
+		return ErrInvalidKey
 	}
-	if c.key == nil {
-		if c.buf.Len() > 0 {
-			return c.buf.Read(p)
+	c.key = nil
+	c.keys = nil
+	c.anyByte = ""
+	c.skips = nil
+	c.prefix = 0
+	c.selector = nil
+	c.split = func(data []byte, atEOF bool) (int, int) {
+		loc := re.FindIndex(data)
+		switch {
+		case loc == nil && atEOF:
+			return len(data), 0
+		case loc == nil:
+			return len(data) - c.maxKey, 0
+		case loc[1] == len(data) && loc[0] >= len(data)-c.maxKey && !atEOF:
+			// A match reaching the end of the buffer may grow with more data
+			return loc[0], 0
 		}
-		return c.rd.Read(p)
+		return loc[0], loc[1] - loc[0]
 	}
-	if c.scan > 0 {
-		return c.readScanned(p)
+	c.setMaxKey(c.bufAdd)
+	return nil
+}
+
+// matchesEmpty reports whether re can match the empty string at some position
+// of the data, taking every empty-width assertion such as \b as satisfiable.
+func matchesEmpty(re *regexp.Regexp) bool {
+	if re.Match(nil) {
+		return true
 	}
-	if c.found {
-		return c.readEOF()
+	sre, err := syntax.Parse(re.String(), syntax.Perl)
+	return err == nil && nullable(sre)
+}
+
+// nullable reports whether re can match the empty string, ignoring the
+// conditions of empty-width assertions.
+func nullable(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary,
+		syntax.OpNoWordBoundary, syntax.OpStar, syntax.OpQuest:
+		return true
+	case syntax.OpLiteral:
+		return len(re.Rune) == 0
+	case syntax.OpCapture, syntax.OpPlus:
+		return nullable(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min == 0 || nullable(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !nullable(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if nullable(sub) {
+				return true
+			}
+		}
 	}
-	c.ierr = c.bufFill()
-	pos := bytes.Index(c.buf.Bytes(), c.key)
-	switch pos {
-	case -1:
-		if c.ierr != nil {
-			// Reached input EOF w/o key
-			c.scan = c.buf.Len()
-			c.err = io.ErrUnexpectedEOF
-			return c.readScanned(p)
+	return false
+}
+
+// SetKeyFunc sets a function that locates the key in the buffered data, for
+// framing that a fixed key cannot describe.  The function is called with the
+// buffered data and whether the underlying stream has ended.  It returns the
+// number of chunk data bytes before the key and the length of the key.  If no
+// key is present it returns a key length of 0 along with the number of bytes
+// that can be delivered as chunk data before it is called again with more
+// data.  Returning 0, 0 while the buffer is full makes Read fail with
+// ErrBufferFull.  At the end of the stream all remaining data is delivered if
+// no key is found.  Setting fn to nil reverts to the keys set by SetKey or
+// SetKeys.
+func (c *Reader) SetKeyFunc(fn KeyFunc) {
+	defer c.lock()()
+	c.split = fn
+	c.prefix = 0
+	c.selector = nil
+	if fn != nil {
+		c.setMaxKey(c.bufAdd)
+	} else {
+		c.setMaxKey(c.maxKeys())
+	}
+}
+
+// SetLengthPrefixed reads the stream as a series of frames, each made of a
+// length prefix of prefixLen bytes followed by that many bytes of chunk data,
+// instead of chunks ended by a key.  The prefix is an unsigned integer in the
+// given byte order, and prefixLen must be 1, 2, 4 or 8, otherwise
+// ErrInvalidKey is returned.  Each chunk ends with io.EOF after the data of its
+// frame, and Reset moves on to the next frame, discarding any data of the
+// current frame that has not been read.  Prefixes are not delivered as data.
+// A stream ending within a frame or its prefix returns ErrKeyNotFound.
+// Setting a key with SetKey, SetKeys, SetKeyRegexp or SetKeyFunc ends this
+// mode.  The next byte read from the stream must be the start of a prefix.
+func (c *Reader) SetLengthPrefixed(byteOrder binary.ByteOrder, prefixLen int) error {
+	defer c.lock()()
+	switch {
+	case prefixLen == 1:
+	case byteOrder == nil:
+		return ErrInvalidKey
+	case prefixLen != 2 && prefixLen != 4 && prefixLen != 8:
+		return ErrInvalidKey
+	}
+	c.key = nil
+	c.keys = nil
+	c.anyByte = ""
+	c.skips = nil
+	c.split = nil
+	c.selector = nil
+	c.order = byteOrder
+	c.prefix = prefixLen
+	c.frame = -1
+	c.frameSkip = 0
+	c.setMaxKey(0)
+	return nil
+}
+
+// maxKeys returns the length of the longest key in keys.
+func (c *Reader) maxKeys() int {
+	n := 0
+	for _, key := range c.keys {
+		if len(key) > n {
+			n = len(key)
 		}
-		c.scan = c.buf.Len() - len(c.key)
-		if c.scan <= 0 {
-			panic("Error: Unexpected error in chunkio.Read()")
+	}
+	return n
+}
+
+// setMaxKey updates the buffer size for keys of up to maxKey bytes.
+func (c *Reader) setMaxKey(maxKey int) {
+	c.maxKey = maxKey
+	c.checked = 0
+	c.last = -1
+	c.bufSize = c.bufAdd + c.maxKey
+	if c.buf.Cap() < c.bufSize {
+		c.buf.Grow(c.bufSize - c.buf.Cap())
+	}
+	c.rescan()
+}
+
+// rescan looks for the key again in the data already buffered, so that a key
+// present there is found by the next read without first filling the buffer.
+// If no key is certain to be found, the next read searches as usual.
+func (c *Reader) rescan() {
+	c.scan = 0
+	c.found = false
+	if c.raw() || c.prefix > 0 || c.buf.Len() == 0 || c.bracket() && !c.inside || c.selector != nil && !c.selected {
+		return
+	}
+	pos, n := c.index()
+	if n > 0 && pos >= 0 && pos+n <= c.buf.Len() && !c.skip(pos, n) {
+		c.setFound(pos, n)
+	}
+}
+
+// byteKey reports whether the keys are single bytes matched exactly, either a
+// single key or those set by SetKeyAnyByte, which are searched for with a
+// simpler scan.
+func (c *Reader) byteKey() bool {
+	return (len(c.keys) == 1 && len(c.keys[0]) == 1 || c.anyByte != "") && c.split == nil && !c.fold
+}
+
+// raw reports whether no key is set, in which case data is read without
+// scanning.
+func (c *Reader) raw() bool {
+	return c.keys == nil && c.split == nil && c.prefix == 0 && c.selector == nil
+}
+
+// SetKeepKey controls whether the key is returned as the final bytes of the
+// chunk instead of being discarded.  By default the key is discarded.  The
+// setting takes effect the next time a key is found.  The kept key bytes are
+// always the last bytes delivered before io.EOF, whatever the size of the
+// reads, so keys used as suffixes of varying length can be trimmed from the
+// end of the chunk using the length of MatchedKey once io.EOF is returned.
+// Only when SetChunkLimit cuts the chunk short are the key bytes not
+// delivered.
+func (c *Reader) SetKeepKey(keep bool) {
+	defer c.lock()()
+	c.keep = keep
+}
+
+// SetMaxChunkSize limits the number of bytes delivered from a single chunk to
+// n.  Once n bytes have been read, reading further data from the chunk returns
+// ErrChunkTooLarge.  The count starts over on Reset.  A limit of 0 means no
+// limit, which is the default.
+func (c *Reader) SetMaxChunkSize(n int) {
+	defer c.lock()()
+	c.maxSize = n
+}
+
+// SetChunkLimit limits the data delivered from each chunk to its first n
+// bytes.  Once n bytes of a chunk have been read, reading returns io.EOF as if
+// the key had been reached, and the rest of the chunk and the key are skipped
+// without being copied.  Unlike SetMaxChunkSize, longer chunks are not an
+// error.  The skipped data is not added to the chunk hash.  A limit of 0 means
+// no limit, which is the default.
+func (c *Reader) SetChunkLimit(n int) {
+	defer c.lock()()
+	c.headSize = n
+}
+
+// SetMaxTotal limits the number of bytes consumed from the stream, as counted by
+// Offset, to n over all chunks.  Once the limit is reached, reading further data
+// returns ErrMaxTotalExceeded, whatever the position in the current chunk.  The
+// count is not affected by Reset.  A limit of 0 means no limit, which is the
+// default.
+func (c *Reader) SetMaxTotal(n int64) {
+	defer c.lock()()
+	c.maxTotal = n
+}
+
+// SetMinChunkSize skips chunks that are shorter than n bytes, along with their
+// key, so only chunks of at least n bytes are returned.  Skipped chunks are not
+// counted by ChunkCount.  SetMinChunkSize(1) skips empty chunks like
+// SetSkipEmpty.  When SetKeepKey is in effect the key counts towards the chunk
+// size.  Data at the end of the stream that is not followed by the key is
+// returned with ErrKeyNotFound as usual, even if it is shorter than n.  Since a
+// chunk must be buffered to know its size, n is limited to the read ahead
+// size.  A minimum of 0 means no minimum, which is the default.
+func (c *Reader) SetMinChunkSize(n int) {
+	defer c.lock()()
+	if n > c.bufAdd {
+		n = c.bufAdd
+	}
+	c.minSize = n
+}
+
+// SetSkipEmpty controls whether empty chunks, where a key immediately follows
+// the previous key or the start of the stream, are skipped.  Skipped chunks
+// are not counted by ChunkCount.  An empty final chunk at the end of the
+// stream still returns ErrKeyNotFound as usual.  By default empty chunks
+// are returned.
+func (c *Reader) SetSkipEmpty(skip bool) {
+	defer c.lock()()
+	c.skipEmpty = skip
+}
+
+// SetSkipLeadingKey controls whether a key at the very start of the stream is
+// skipped, so that the first chunk is the one following it rather than an
+// empty chunk.  This suits formats that begin with a delimiter.  Unlike
+// SetSkipEmpty, later empty chunks are still returned.  The setting takes
+// effect if no data has been consumed from the stream yet.
+func (c *Reader) SetSkipLeadingKey(skip bool) {
+	defer c.lock()()
+	c.skipLead = skip
+	c.rescan()
+}
+
+// SetEagerEOF controls whether Read returns io.EOF together with the last bytes
+// of a chunk when the key is known to follow them, saving a Read call that
+// would only return io.EOF.  This is allowed by the io.Reader contract and is
+// handled by io.ReadAll and similar functions, but callers that stop at the
+// first error without using the returned bytes must not enable it.  By default
+// io.EOF is returned by a separate Read with a count of zero.
+func (c *Reader) SetEagerEOF(eager bool) {
+	defer c.lock()()
+	c.eagerEOF = eager
+}
+
+// SetEOFTerminates controls whether the end of the stream ends the last chunk
+// like a key, for formats where the last record is not followed by the key.
+// The data after the last key is then delivered as a complete chunk ending
+// with io.EOF instead of ErrKeyNotFound, Complete reports true and the chunk is
+// counted by ChunkCount.  Reading once the stream is exhausted still returns
+// ErrKeyNotFound, so loops reading chunks end as usual.  An underlying Reader
+// failing with an error other than io.EOF, or a frame cut short in length
+// prefixed mode, is still reported as an error.
+func (c *Reader) SetEOFTerminates(term bool) {
+	defer c.lock()()
+	c.eofTerm = term
+}
+
+// SetUnescape decodes chunk data written by a Writer with the same escape
+// sequence set by SetEscape, making the chunks read identical to those written.
+// Each escape sequence in the chunk is removed and the byte following it is
+// restored.  ReadRune, Peek and WriteTo return decoded data as well, while
+// SetMaxChunkSize and SetMaxTotal keep counting the bytes of the stream.  The
+// sequence must be shorter than the minimum read ahead size of 16 bytes,
+// otherwise ErrInvalidEscape is returned.  A nil esc turns decoding off, which
+// is the default.
+func (c *Reader) SetUnescape(esc []byte) error {
+	defer c.lock()()
+	if esc != nil && (len(esc) == 0 || len(esc) >= minBufAdd) {
+		return ErrInvalidEscape
+	}
+	c.esc = append([]byte(nil), esc...)
+	if esc == nil {
+		c.esc = nil
+	}
+	return nil
+}
+
+// SetChunkDecoder decodes chunk data with dec as it is read, so that chunks of
+// encoded data, such as lines of base64, are delivered decoded.  The key is
+// still searched for in the encoded stream.  dec is passed the encoded data in
+// units of group bytes, 4 for base64 and 2 for hex, except for the end of the
+// chunk, which is passed as is so that dec can reject an incomplete unit.  The
+// decoded data must not be longer than the encoded data, as dst is only as
+// long as src.  An error of dec is returned by the read and ends the chunk
+// until Reset.  Read and the methods built on it return decoded data, while
+// Peek, PeekChunk, ChunkLen and ReadRune return the encoded data, and
+// SetMaxChunkSize, SetMaxTotal and the chunk hash of SetChunkHash apply to the
+// encoded data.  The decoded data is passed to any transform set by
+// SetTransform.  While a decoder is set SetUnescape has no effect.
+// ErrInvalidDecoder is returned if group is not between 1 and 15.  A nil dec
+// turns decoding off, which is the default.
+func (c *Reader) SetChunkDecoder(group int, dec Decoder) error {
+	defer c.lock()()
+	if dec == nil {
+		c.decode = nil
+		return nil
+	}
+	if group < 1 || group >= minBufAdd {
+		return ErrInvalidDecoder
+	}
+	c.decode = dec
+	c.group = group
+	return nil
+}
+
+// SetTransform sets a function that rewrites chunk data in place before it is
+// returned, so chunks can be case folded, descrambled or remapped while they
+// stream.  fn is called on each slice of chunk data delivered by Read and the
+// methods built on it, after any decoding done for SetUnescape.  Keys are not
+// passed to fn, even with SetKeepKey, and neither is data read while no key is
+// set.  Peek and ReadRune return data without the transform, and the chunk
+// hash of SetChunkHash is computed before it.  A nil fn removes the transform.
+func (c *Reader) SetTransform(fn func(p []byte)) {
+	defer c.lock()()
+	c.transform = fn
+}
+
+// transformData applies the transform to chunk data just delivered in b,
+// leaving out the bytes of a key kept with SetKeepKey.
+func (c *Reader) transformData(b []byte) {
+	if c.transform == nil {
+		return
+	}
+	if c.found && c.drop == 0 {
+		// A kept key is at the end of the scanned bytes
+		if k := len(c.match) - c.scan; k > 0 {
+			b = b[:max(len(b)-k, 0)]
 		}
-		return c.readScanned(p)
-	case 0:
-		c.scan = 0
-		c.found = true
-		return c.readEOF()
-	default:
-		c.scan = pos
-		c.found = true
-		return c.readScanned(p)
 	}
+	c.transform(b)
+}
+
+// SetRetainChunks controls whether the Reader keeps a copy of the data delivered
+// from each chunk, which LastChunk returns once the chunk has ended.  This
+// saves callers reading in small pieces from assembling chunks themselves.
+// Keys are only included with SetKeepKey, and data skipped by Discard or
+// read while no key is set is not kept.  Turning retention off releases the
+// kept data.
+func (c *Reader) SetRetainChunks(retain bool) {
+	defer c.lock()()
+	c.retain = retain
+	if !retain {
+		c.kept = nil
+		c.lastChunk = nil
+	}
+}
+
+// LastChunk returns the data of the most recently ended chunk when
+// SetRetainChunks is on, whether it ended with the key or with the end of the
+// stream, or nil if no chunk has ended since.  The returned slice is not
+// modified by the Reader and may be retained.
+func (c *Reader) LastChunk() []byte {
+	defer c.lockState()()
+	return c.lastChunk
+}
+
+// retainData adds chunk data delivered to the caller to the kept data.
+func (c *Reader) retainData(b []byte) {
+	if c.retain {
+		c.kept = append(c.kept, b...)
+	}
+}
+
+// endRetain makes the data kept from the chunk that just ended available to
+// LastChunk.
+func (c *Reader) endRetain() {
+	if !c.retain {
+		return
+	}
+	c.lastChunk = c.kept
+	if c.lastChunk == nil {
+		c.lastChunk = []byte{}
+	}
+	c.kept = nil
+}
+
+// SetChunkHash sets a hash that is computed over the data of each chunk as it is
+// read, for checking the integrity of chunks without buffering them.  All data
+// delivered from the chunk, including data skipped by Discard or SkipChunk, is
+// written to h.  The key is only included when SetKeepKey is in effect.  When
+// a chunk ends, its sum is recorded for ChunkSum and h is Reset for the next
+// chunk.  A nil h stops hashing.
+func (c *Reader) SetChunkHash(h hash.Hash) {
+	defer c.lock()()
+	c.hash = h
+	c.sum = nil
+	c.unhashed = 0
+	if h != nil {
+		h.Reset()
+	}
+}
+
+// ChunkSum returns the sum of the hash set by SetChunkHash for the last chunk
+// that ended, either at the key or at the end of the stream.  It returns nil if
+// no chunk has ended since the hash was set.
+func (c *Reader) ChunkSum() []byte {
+	defer c.lockState()()
+	if c.sum == nil {
+		return nil
+	}
+	return append([]byte(nil), c.sum...)
+}
+
+// SetSynchronized controls whether all methods of the Reader are guarded by a
+// mutex, so that methods such as Stats or Buffered can be called from another
+// goroutine while reading.  This only protects the Reader from data races: the
+// order in which concurrent reads get their data is undefined, so they remain
+// of little use.  Chunks and ForEachChunk do not hold the mutex while calling
+// back.  The mutex is not held while waiting on the underlying Reader either,
+// so methods that only report on the Reader, such as Stats, Buffered, Offset
+// or ChunkCount, return at once even if the underlying Reader stalls, while
+// the other methods wait for the read to end.  SetSynchronized must be called
+// before the Reader is shared.  By default the Reader is not synchronized.
+func (c *Reader) SetSynchronized(on bool) {
+	if !on {
+		c.mu = nil
+		c.ioDone = nil
+	} else if c.mu == nil {
+		c.mu = new(sync.Mutex)
+		c.ioDone = sync.NewCond(c.mu)
+	}
+}
+
+// lock acquires the mutex of a synchronized Reader, waiting for any read of
+// the underlying Reader to end, and returns the function that releases it.
+func (c *Reader) lock() func() {
+	if c.mu == nil {
+		return unlockNop
+	}
+	c.mu.Lock()
+	for c.reading {
+		c.ioDone.Wait()
+	}
+	return c.mu.Unlock
+}
+
+// lockState is lock for methods that only look at the state of the Reader,
+// which does not change while the underlying Reader is being read, so they
+// need not wait for the read to end.
+func (c *Reader) lockState() func() {
+	if c.mu == nil {
+		return unlockNop
+	}
+	c.mu.Lock()
+	return c.mu.Unlock
+}
+
+// unlockIO releases the mutex of a synchronized Reader while the underlying
+// Reader is read, and returns the function that acquires it again.  Only the
+// methods using lockState can run in the meantime.
+func (c *Reader) unlockIO() func() {
+	if c.mu == nil {
+		return unlockNop
+	}
+	c.reading = true
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		c.reading = false
+		c.ioDone.Broadcast()
+	}
+}
+
+func unlockNop() {}
+
+// SetTee sets a Writer that receives a copy of every byte read from the
+// underlying Reader, including keys and data that has not been delivered yet.
+// If writing to w fails, the error is returned by the current and all later
+// reads, even after Reset, and no more data is read from the underlying
+// Reader.  A nil w stops copying.
+func (c *Reader) SetTee(w io.Writer) {
+	defer c.lock()()
+	c.tee = w
+}
+
+// SetMarker sets a marker, such as a heartbeat sequence, whose every
+// appearance in the stream is reported by calling fn with its offset.  Unlike a
+// key the marker does not end the chunk and its bytes are delivered as part of
+// the chunk data.  The stream is searched for the marker as it is read from
+// the underlying Reader, so fn may be called before the data before the marker
+// is delivered, and markers inside keys and skipped data are reported too.
+// Markers that overlap are reported once.  fn is called with the Reader locked
+// and must not call its methods.  A nil marker removes the marker.
+func (c *Reader) SetMarker(marker []byte, fn func(offset int64)) {
+	defer c.lock()()
+	c.marker = nil
+	c.markFn = nil
+	c.mtail = nil
+	if len(marker) > 0 && fn != nil {
+		c.marker = append([]byte(nil), marker...)
+		c.markFn = fn
+		c.mtail = make([]byte, 0, 2*len(marker))
+	}
+}
+
+// markData reports the markers in p, the data read from the underlying Reader
+// before it is added to the buffer.
+func (c *Reader) markData(p []byte) {
+	if c.marker == nil || len(p) == 0 {
+		return
+	}
+	m := len(c.marker)
+	off := c.off + int64(c.buf.Len())
+	from := 0
+	if t := len(c.mtail); t > 0 {
+		// Only a marker starting in the data before p fits here
+		b := append(c.mtail, p[:min(len(p), m-1)]...)
+		if j := bytes.Index(b, c.marker); j >= 0 {
+			c.markFn(off - int64(t-j))
+			from = j + m - t
+		}
+	}
+	for {
+		j := bytes.Index(p[from:], c.marker)
+		if j < 0 {
+			break
+		}
+		c.markFn(off + int64(from+j))
+		from += j + m
+	}
+	if from == 0 && len(p) < m-1 {
+		c.mtail = append(c.mtail, p...)
+		if n := len(c.mtail) - (m - 1); n > 0 {
+			c.mtail = append(c.mtail[:0], c.mtail[n:]...)
+		}
+		return
+	}
+	keep := p[from:]
+	if len(keep) > m-1 {
+		keep = keep[len(keep)-m+1:]
+	}
+	c.mtail = append(c.mtail[:0], keep...)
+}
+
+// SetTrace sets a Writer that receives a line of text after each read,
+// describing its result and the state of the key search: the number of bytes
+// in the buffer, the number of scanned bytes ready to be delivered, whether a
+// key was found and its position in the buffer, or -1.  It is meant for
+// diagnosing why a stream is not split as expected, and the format may change.
+// Errors writing to w are ignored.  A nil w stops tracing.
+func (c *Reader) SetTrace(w io.Writer) {
+	defer c.lock()()
+	c.trace = w
+}
+
+// traceRead writes the trace line of a read that returned n and err.
+func (c *Reader) traceRead(n int, err error) {
+	pos := -1
+	if c.found {
+		pos = c.scan
+		if c.keep {
+			pos -= len(c.match)
+		}
+	}
+	fmt.Fprintf(c.trace, "chunkio: read n=%d err=%v buf=%d scan=%d found=%t match=%d\n",
+		n, err, c.buf.Len(), c.scan, c.found, pos)
+}
+
+// SetCaseInsensitive controls whether keys are matched ignoring case.  Only
+// ASCII letters are folded; bytes of multibyte UTF-8 sequences must match
+// exactly.  The key bytes discarded at the end of a chunk are those from the
+// stream, whatever their case.
+func (c *Reader) SetCaseInsensitive(ci bool) {
+	defer c.lock()()
+	c.fold = ci
+	c.checked = 0
+	c.rescan()
+}
+
+// Reset puts the chunkio stream back into a readable state.  This can be used
+// when the end of a chunk is reached to enable reading the next chunk.
+func (c *Reader) Reset() {
+	defer c.lock()()
+	c.reset()
+}
+
+// reset is Reset for a Reader that is already locked.
+func (c *Reader) reset() {
+	switch {
+	case c.err == ErrClosed, c.terr != nil:
+	case c.buf.Len() == 0 && c.ierr != nil:
+		c.err = c.eofErr()
+	default:
+		c.err = nil
+	}
+	if c.prefix > 0 && c.frame >= 0 {
+		c.frameSkip += c.frame - int64(c.size)
+		c.frame = -1
+	}
+	c.scan = 0
+	c.found = false
+	c.last = -1
+	c.size = 0
+	c.matched = -1
+	c.inside = false
+	c.selected = false
+	c.kept = c.kept[:0]
+}
+
+// ResetErr is like Reset but also reports whether the stream can still be read.
+// It returns io.EOF if the underlying Reader has reached its end and all data
+// has been read, so that a loop reading chunks can stop on it.  If the Reader
+// is closed or the underlying Reader failed, that error is returned instead.
+// Otherwise it returns nil, though the next chunk may still turn out to be an
+// empty chunk at the end of the stream.
+func (c *Reader) ResetErr() error {
+	defer c.lock()()
+	c.reset()
+	if c.err == ErrKeyNotFound {
+		return io.EOF
+	}
+	return c.err
+}
+
+// ResetReader switches the Reader to read from rd, keeping the keys, settings
+// and internal buffer, so a Reader can be reused for another stream without
+// allocating a new one.  Any unread data of the previous stream, including data
+// in the internal buffer, is discarded.  The chunk count and offset restart at
+// zero, and a closed Reader or a failed write to the tee is cleared.
+func (c *Reader) ResetReader(rd io.Reader) {
+	defer c.lock()()
+	c.rd = rd
+	c.pending = nil
+	c.terr = nil
+	c.clear(0)
+}
+
+// ResetFull returns the Reader to the state of a new Reader over the same
+// underlying Reader, with the same read ahead size and synchronization.  Unlike
+// Reset, which only moves on to the next chunk, it also removes the keys and
+// every setting, such as the transform, chunk hash, tee, marker and limits,
+// and clears any error, including one returned by the underlying Reader, which
+// is read again.  Data in the internal buffer is kept, so no data of the stream
+// is lost, and so is the buffer capacity.  The offset is kept while the chunk
+// count restarts at zero.  A closed Reader stays closed.
+func (c *Reader) ResetFull() {
+	defer c.lock()()
+	r := NewReaderSize(c.rd, c.bufAdd)
+	r.buf = c.buf
+	r.tmp = c.tmp
+	r.pending = c.pending
+	r.mu = c.mu
+	r.off = c.off
+	r.checked = c.off
+	if c.err == ErrClosed {
+		r.err = ErrClosed
+	}
+	*c = *r
+}
+
+func (c *Reader) readScanned(p []byte) (int, error) {
+	if c.decode != nil {
+		return c.readDecoded(p)
+	}
+	if c.esc != nil {
+		return c.readEscaped(p)
+	}
+	n, err := c.limit()
+	if err != nil {
+		return 0, err
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	n = copy(p, c.next(n))
+	c.transformData(p[:n])
+	c.retainData(p[:n])
+	return n, nil
+}
+
+// readEscaped decodes scanned bytes into p for SetUnescape.  An escape sequence
+// that is cut off by the end of the scanned bytes is only delivered once more
+// of the chunk has been scanned.
+func (c *Reader) readEscaped(p []byte) (int, error) {
+	for {
+		n, err := c.limit()
+		if err != nil {
+			return 0, err
+		}
+		end := n == c.scan && (c.found || c.ierr != nil)
+		k, m := unescape(p, c.buf.Bytes()[:n], c.esc, end)
+		if m > 0 {
+			c.next(m)
+			c.hashData(p[:k])
+			c.transformData(p[:k])
+			c.retainData(p[:k])
+			return k, nil
+		}
+		if n < c.scan {
+			return 0, c.overLimit(len(c.esc) + 1)
+		}
+		scan := c.scan
+		if err := c.search(); err != nil {
+			return 0, err
+		}
+		if c.scan == scan && !c.found && c.ierr == nil {
+			c.err = ErrBufferFull
+			return 0, c.err
+		}
+	}
+}
+
+// readDecoded decodes scanned bytes for SetChunkDecoder and delivers them to p.
+// Decoded data that does not fit in p is kept for the next read.
+func (c *Reader) readDecoded(p []byte) (int, error) {
+	for len(c.decoded) == 0 {
+		if c.scan == 0 {
+			return 0, nil
+		}
+		n, err := c.limit()
+		if err != nil {
+			return 0, err
+		}
+		m := n
+		if n < c.scan || !c.found && c.ierr == nil {
+			m -= m % c.group
+		}
+		if m == 0 {
+			if n < c.scan {
+				return 0, c.overLimit(c.group)
+			}
+			scan := c.scan
+			if err := c.search(); err != nil {
+				return 0, err
+			}
+			if c.scan == scan && !c.found && c.ierr == nil {
+				c.err = ErrBufferFull
+				return 0, c.err
+			}
+			continue
+		}
+		if cap(c.dtmp) < m {
+			c.dtmp = make([]byte, m)
+		}
+		k, err := c.decode(c.dtmp[:m], c.buf.Bytes()[:m])
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+		c.next(m)
+		c.decoded = c.dtmp[:k]
+	}
+	n := copy(p, c.decoded)
+	c.decoded = c.decoded[n:]
+	c.transformData(p[:n])
+	c.retainData(p[:n])
+	return n, nil
+}
+
+// unescape decodes src into dst, returning the number of bytes written to dst
+// and consumed from src.  An escape sequence that is incomplete at the end of
+// src is left unconsumed, unless end is set, in which case it is copied as is.
+func unescape(dst, src, esc []byte, end bool) (n, m int) {
+	for n < len(dst) && m < len(src) {
+		switch {
+		case src[m] != esc[0]:
+		case len(src)-m > len(esc):
+			if bytes.HasPrefix(src[m:], esc) {
+				dst[n] = src[m+len(esc)] ^ escXor
+				n++
+				m += len(esc) + 1
+				continue
+			}
+		case !end:
+			return n, m
+		}
+		dst[n] = src[m]
+		n++
+		m++
+	}
+	return n, m
+}
+
+// overLimit sets and returns the error for size bytes that cannot be delivered
+// without exceeding the maximum chunk size or the maximum total size.
+func (c *Reader) overLimit(size int) error {
+	c.err = ErrChunkTooLarge
+	if c.maxTotal > 0 && c.off+int64(size) > c.maxTotal {
+		c.err = ErrMaxTotalExceeded
+	}
+	return c.err
+}
+
+// limit returns the number of scanned bytes that can be delivered without
+// exceeding the chunk limit, the maximum chunk size or the maximum total size.
+// Once the chunk limit is reached the rest of the chunk is skipped.
+func (c *Reader) limit() (int, error) {
+	n := c.scan
+	if c.headSize > 0 {
+		if c.size >= c.headSize {
+			return 0, c.skipTail()
+		}
+		if r := c.headSize - c.size; n > r {
+			n = r
+		}
+	}
+	if c.maxSize > 0 {
+		if c.size >= c.maxSize {
+			c.err = ErrChunkTooLarge
+			return 0, c.err
+		}
+		if r := c.maxSize - c.size; n > r {
+			n = r
+		}
+	}
+	return c.total(n)
+}
+
+// skipTail discards the rest of the current chunk and its key without
+// delivering it, returning the error that ended the chunk.
+func (c *Reader) skipTail() error {
+	for {
+		if c.scan == 0 && !c.found {
+			if err := c.search(); err != nil {
+				return err
+			}
+		}
+		if c.scan == 0 {
+			_, err := c.readEOF()
+			return err
+		}
+		n, err := c.total(c.scan)
+		if err != nil {
+			return err
+		}
+		c.buf.Next(n)
+		c.scan -= n
+		c.size += n
+		c.off += int64(n)
+	}
+}
+
+// total limits n to the number of bytes that can be delivered without
+// exceeding the maximum total size.
+func (c *Reader) total(n int) (int, error) {
+	if c.maxTotal <= 0 || n == 0 {
+		return n, nil
+	}
+	r := c.maxTotal - c.off
+	if r <= 0 {
+		c.err = ErrMaxTotalExceeded
+		return 0, c.err
+	}
+	if int64(n) > r {
+		n = int(r)
+	}
+	return n, nil
+}
+
+// next consumes n scanned bytes from the buffer.
+func (c *Reader) next(n int) []byte {
+	c.scan -= n
+	c.size += n
+	c.off += int64(n)
+	b := c.buf.Next(n)
+	if c.esc == nil {
+		c.hashData(b)
+	}
+	return b
+}
+
+// hashData adds chunk data delivered to the caller to the chunk hash.  Data
+// that was unread and then delivered again is only added once.
+func (c *Reader) hashData(b []byte) {
+	if c.hash == nil {
+		return
+	}
+	if c.unhashed > 0 {
+		n := c.unhashed
+		if n > len(b) {
+			n = len(b)
+		}
+		b = b[n:]
+		c.unhashed -= n
+	}
+	c.hash.Write(b)
+}
+
+// endHash records the sum of the chunk that just ended and starts the hash of
+// the next chunk.
+func (c *Reader) endHash() {
+	if c.hash == nil {
+		return
+	}
+	c.sum = c.hash.Sum(c.sum[:0])
+	c.hash.Reset()
+	c.unhashed = 0
+}
+
+// readRaw reads without scanning for a key, draining the buffer before reading
+// from the underlying Reader.
+func (c *Reader) readRaw(p []byte) (n int, err error) {
+	if n, err = c.total(len(p)); err != nil {
+		return 0, err
+	}
+	p = p[:n]
+	if c.buf.Len() == 0 && c.ierr == nil && (c.ctx != nil || c.pending != nil) {
+		abort, err := c.readOnce(len(p))
+		if abort != nil {
+			return 0, abort
+		}
+		c.ierr = err
+	}
+	switch {
+	case c.buf.Len() > 0:
+		n, err = c.buf.Read(p)
+	case c.ierr != nil:
+		// The underlying Reader is not read again after an error
+		return 0, c.ierr
+	default:
+		relock := c.unlockIO()
+		n, err = c.rd.Read(p)
+		relock()
+		err = c.progress(n, err)
+		c.ierr = err
+		c.markData(p[:n])
+		if abort := c.teeWrite(p[:n]); abort != nil {
+			err = abort
+		}
+	}
+	c.off += int64(n)
+	c.hashData(p[:n])
+	return n, err
+}
+
+// unlocked reads from a Reader that is already locked.
+type unlocked struct {
+	c *Reader
+}
+
+func (u unlocked) Read(p []byte) (int, error) {
+	return u.c.read(p)
+}
+
+// passthrough is the io.Reader returned by Passthrough.
+type passthrough struct {
+	c *Reader
+}
+
+func (r passthrough) Read(p []byte) (int, error) {
+	c := r.c
+	defer c.lock()()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	defer func(keep bool) {
+		c.keep = keep
+		if !keep && c.found && c.drop == 0 && c.scan >= len(c.match) {
+			// Leave a key found during the call to be discarded
+			c.scan -= len(c.match)
+			c.drop = len(c.match)
+		}
+	}(c.keep)
+	c.keep = true
+	if c.found && c.drop > 0 {
+		// Deliver a key found before the call along with the chunk
+		c.scan += c.drop
+		c.drop = 0
+	}
+	for {
+		n, err := c.read(p)
+		switch {
+		case err == io.EOF && n == 0:
+			c.reset()
+			if c.err == nil {
+				continue
+			}
+			if c.err == ErrKeyNotFound {
+				return 0, io.EOF
+			}
+			return 0, c.err
+		case err == io.EOF:
+			c.reset()
+			return n, nil
+		case err == ErrKeyNotFound:
+			return n, io.EOF
+		case err == nil && c.found && c.scan == 0:
+			// The key has been delivered
+			c.readEOF()
+			c.reset()
+		}
+		return n, err
+	}
+}
+
+// residual is the io.Reader returned by Residual.
+type residual struct {
+	c *Reader
+}
+
+func (r residual) Read(p []byte) (int, error) {
+	c := r.c
+	defer c.lock()()
+	switch {
+	case c.err == ErrClosed:
+		return 0, ErrClosed
+	case c.terr != nil:
+		return 0, c.terr
+	case len(p) == 0:
+		return 0, nil
+	}
+	c.last = -1
+	c.scan = 0
+	c.found = false
+	c.drop = 0
+	return c.readRaw(p)
+}
+
+func (c *Reader) readEOF() (int, error) {
+	// Discard key from input stream
+	if n := len(c.buf.Next(c.drop)); n != c.drop {
+		c.off += int64(n)
+		c.err = fmt.Errorf("%w: only %d of %d key bytes in buffer", ErrInternal, n, c.drop)
+		return 0, c.err
+	}
+	c.off += int64(c.drop)
+	c.chunks++
+	c.complete = true
+	c.matched = c.hit
+	c.keyOff = c.off - int64(len(c.match))
+	if c.prefix > 0 {
+		c.matched = -1
+		c.keyOff = -1
+	}
+	c.endHash()
+	c.endRetain()
+	// Set / return EOF
+	c.err = io.EOF
+	return 0, io.EOF
+}
+
+func (c *Reader) bufFill() error {
+	for c.ierr == nil && c.buf.Len() < c.bufSize {
+		abort, err := c.readOnce(c.bufSize - c.buf.Len())
+		if abort != nil {
+			return abort
+		}
+		c.ierr = err
+	}
+	return nil
+}
+
+// readOnce appends the result of a single read of up to n bytes from the
+// underlying Reader to the buffer.  If a context is set the read is done in a
+// goroutine so it can be abandoned when the context is done.  The data of an
+// abandoned read is kept and added to the buffer by the next call.  An error
+// that must end the current operation, such as the context error, is returned
+// as abort, while err is the error returned by the underlying Reader.
+func (c *Reader) readOnce(n int) (abort, err error) {
+	if c.ctx == nil && c.pending == nil {
+		if cap(c.tmp) < n {
+			c.tmp = make([]byte, n)
+		}
+		relock := c.unlockIO()
+		n, err = c.rd.Read(c.tmp[:n])
+		relock()
+		c.markData(c.tmp[:n])
+		c.buf.Write(c.tmp[:n])
+		return c.teeWrite(c.tmp[:n]), c.progress(n, err)
+	}
+	if c.pending == nil {
+		rd, b, ch := c.rd, make([]byte, n), make(chan readResult, 1)
+		go func() {
+			n, err := rd.Read(b)
+			ch <- readResult{b[:n], err}
+		}()
+		c.pending = ch
+	}
+	var done <-chan struct{}
+	if c.ctx != nil {
+		done = c.ctx.Done()
+	}
+	relock := c.unlockIO()
+	select {
+	case r := <-c.pending:
+		relock()
+		c.pending = nil
+		c.markData(r.data)
+		c.buf.Write(r.data)
+		return c.teeWrite(r.data), c.progress(len(r.data), r.err)
+	case <-done:
+		relock()
+		return c.ctx.Err(), nil
+	}
+}
+
+// progress counts reads of the underlying Reader returning no data and no
+// error, and returns io.ErrNoProgress in place of err once there have been too
+// many in a row, so that a misbehaving Reader cannot stall the Reader forever.
+func (c *Reader) progress(n int, err error) error {
+	if n > 0 || err != nil {
+		c.empty = 0
+		return err
+	}
+	c.empty++
+	if c.empty >= maxConsecutiveEmptyReads {
+		c.empty = 0
+		return io.ErrNoProgress
+	}
+	return nil
+}
+
+// teeWrite copies data read from the underlying Reader to the tee Writer, if
+// any.  A failed write stops further reads from the underlying Reader and its
+// error is returned by all later reads, even after Reset.
+func (c *Reader) teeWrite(p []byte) error {
+	if c.tee == nil || len(p) == 0 {
+		return nil
+	}
+	if _, err := c.tee.Write(p); err != nil {
+		c.err = err
+		c.ierr = err
+		c.terr = err
+		return err
+	}
+	return nil
+}
+
+// index searches the buffer for the earliest key.  If a key is found, its
+// position and length are returned and the key is stored in match.  Otherwise
+// the length is 0 and the position is the number of bytes at the start of the
+// buffer that cannot be part of a key.
+func (c *Reader) index() (int, int) {
+	b := c.buf.Bytes()
+	atEOF := c.ierr != nil
+	c.match = nil
+	c.hit = -1
+	if c.split != nil {
+		pos, n := c.split(b, atEOF)
+		if n > 0 && pos >= 0 && pos+n <= len(b) {
+			c.match = append([]byte(nil), b[pos:pos+n]...)
+			c.hit = 0
+		}
+		return pos, n
+	}
+	// Skip the part of the buffer already known not to contain a key
+	from := int(c.checked - c.off)
+	if from < 0 {
+		from = 0
+	}
+	pos := -1
+	if c.anyByte != "" && !c.fold {
+		// Search for all the single byte keys at once
+		if p := bytes.IndexAny(b[min(from, len(b)):], c.anyByte); p >= 0 {
+			pos = min(from, len(b)) + p
+			c.hit = strings.IndexByte(c.anyByte, b[pos])
+			c.match = c.keys[c.hit]
+		}
+	} else {
+		for i, key := range c.keys {
+			lim := b
+			if e := pos + len(key) - 1; pos >= 0 && e < len(b) {
+				// Only a match starting before pos is of interest
+				lim = b[:e]
+			}
+			if from > len(lim) {
+				continue
+			}
+			if p := c.find(lim[from:], i); p >= 0 {
+				pos = from + p
+				c.match = key
+				c.hit = i
+			}
+		}
+	}
+	if c.wild >= 0 && pos >= 0 {
+		// Report the bytes matched by the wildcards
+		c.match = append([]byte(nil), b[pos:pos+len(c.match)]...)
+	}
+	if atEOF {
+		if pos == -1 {
+			c.checked = c.off + int64(len(b))
+			return len(b), 0
+		}
+		c.checked = c.off + int64(pos)
+		return pos, len(c.match)
+	}
+	// A match this close to the end of the buffer could be overtaken by a
+	// longer key at the same position once more data is read.
+	if pos == -1 || pos > len(b)-c.maxKey {
+		c.match = nil
+		c.hit = -1
+		c.checked = c.off + int64(len(b)-c.maxKey+1)
+		return len(b) - c.maxKey, 0
+	}
+	c.checked = c.off + int64(pos)
+	return pos, len(c.match)
+}
+
+// find returns the index of the first instance of the i'th key in b, or -1 if
+// the key is not present in b.
+func (c *Reader) find(b []byte, i int) int {
+	switch {
+	case c.wild >= 0:
+		return indexWild(b, c.keys[i], byte(c.wild), c.fold)
+	case c.fold:
+		return indexFold(b, c.keys[i])
+	case c.skips[i] != nil:
+		return indexBMH(b, c.keys[i], c.skips[i])
+	}
+	return bytes.Index(b, c.keys[i])
+}
+
+// skipTable builds the Boyer-Moore-Horspool table giving the distance the
+// search can move ahead when a byte is found in line with the end of key.
+func skipTable(key []byte) *[256]int {
+	var t [256]int
+	for i := range t {
+		t[i] = len(key)
+	}
+	for i := 0; i < len(key)-1; i++ {
+		t[key[i]] = len(key) - 1 - i
+	}
+	return &t
+}
+
+// indexBMH returns the index of the first instance of key in b using the
+// Boyer-Moore-Horspool algorithm, or -1 if key is not present in b.
+func indexBMH(b, key []byte, skip *[256]int) int {
+	last := len(key) - 1
+	for i := 0; i+last < len(b); i += skip[b[i+last]] {
+		j := last
+		for b[i+j] == key[j] {
+			if j == 0 {
+				return i
+			}
+			j--
+		}
+	}
+	return -1
+}
+
+// indexFold returns the index of the first instance of key in b ignoring ASCII
+// case, or -1 if key is not present in b.
+func indexFold(b, key []byte) int {
+	for i := 0; i+len(key) <= len(b); i++ {
+		j := 0
+		for j < len(key) && lower(b[i+j]) == lower(key[j]) {
+			j++
+		}
+		if j == len(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexWild returns the index of the first instance of key in b, where bytes
+// of key equal to wild match any byte, or -1 if key is not present in b.  If
+// fold is set ASCII case is ignored.
+func indexWild(b, key []byte, wild byte, fold bool) int {
+	for i := 0; i+len(key) <= len(b); i++ {
+		j := 0
+		for j < len(key) && (key[j] == wild || b[i+j] == key[j] || fold && lower(b[i+j]) == lower(key[j])) {
+			j++
+		}
+		if j == len(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lower returns the lower case of an ASCII letter, or b unchanged otherwise.
+func lower(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// truncated ends a chunk at the end of the stream without a key.
+func (c *Reader) truncated() error {
+	if c.eofTerm && c.ierr == io.EOF && c.size > 0 && c.prefix == 0 {
+		// The end of the stream acts as the key
+		c.chunks++
+		c.complete = true
+		c.matched = -1
+		c.keyOff = -1
+		c.endHash()
+		c.endRetain()
+		c.err = io.EOF
+		return c.err
+	}
+	c.err = c.eofErr()
+	c.complete = false
+	c.keyOff = -1
+	c.endHash()
+	c.endRetain()
+	return c.err
+}
+
+// eofErr returns the error for a stream that ended before the key.  This is
+// ErrKeyNotFound if the underlying Reader reached its end, otherwise the
+// error it failed with.
+func (c *Reader) eofErr() error {
+	if c.ierr == io.EOF {
+		return ErrKeyNotFound
+	}
+	return c.ierr
+}
+
+// search fills the buffer and looks for the next key, setting scan to the
+// number of bytes that can be delivered and found if the key follows them.
+func (c *Reader) search() error {
+	if c.prefix > 0 {
+		return c.searchFrame()
+	}
+	for {
+		if c.bracket() && !c.inside {
+			if err := c.seekStart(); err != nil {
+				return err
+			}
+		}
+		if c.selector != nil && !c.selected {
+			if err := c.selectKey(); err != nil {
+				return err
+			}
+		}
+		var pos, n int
+		if c.byteKey() {
+			// A single byte key already buffered is found without reading
+			// more, as no other key can overtake it
+			pos, n = c.index()
+		}
+		if n == 0 {
+			if err := c.bufFill(); err != nil {
+				return err
+			}
+			pos, n = c.index()
+		}
+		if pos < 0 || n < 0 || pos+n > c.buf.Len() {
+			c.err = ErrKeyFunc
+			return c.err
+		}
+		if n == 0 {
+			if c.ierr != nil {
+				// Reached input EOF w/o key
+				if c.buf.Len() == 0 {
+					return c.truncated()
+				}
+				c.scan = c.buf.Len()
+				return nil
+			}
+			if pos == 0 {
+				c.err = ErrBufferFull
+				return c.err
+			}
+			c.scan = pos
+			return nil
+		}
+		if c.skip(pos, n) {
+			// Skip a short chunk along with its key
+			c.buf.Next(pos + n)
+			c.off += int64(pos + n)
+			c.inside = false
+			c.selected = false
+			continue
+		}
+		c.setFound(pos, n)
+		return nil
+	}
+}
+
+// searchFrame is search for length prefixed frames.  The prefix of the frame is
+// read first, and found is set once the rest of the frame is in the buffer.
+func (c *Reader) searchFrame() error {
+	for {
+		if err := c.bufFill(); err != nil {
+			return err
+		}
+		if c.frameSkip > 0 {
+			// Discard the unread data of the previous frame
+			n := int64(c.buf.Len())
+			if n > c.frameSkip {
+				n = c.frameSkip
+			}
+			c.buf.Next(int(n))
+			c.off += n
+			c.frameSkip -= n
+			if c.frameSkip == 0 || c.ierr == nil {
+				continue
+			}
+		}
+		if c.frameSkip > 0 || c.frame < 0 && c.buf.Len() < c.prefix {
+			// Reached input EOF w/o a complete frame
+			return c.truncated()
+		}
+		if c.frame < 0 {
+			var n uint64
+			switch b := c.buf.Next(c.prefix); c.prefix {
+			case 1:
+				n = uint64(b[0])
+			case 2:
+				n = uint64(c.order.Uint16(b))
+			case 4:
+				n = uint64(c.order.Uint32(b))
+			default:
+				n = c.order.Uint64(b)
+			}
+			c.off += int64(c.prefix)
+			if int64(n) < 0 {
+				c.err = ErrChunkTooLarge
+				return c.err
+			}
+			c.frame = int64(n)
+			continue
+		}
+		remain := c.frame - int64(c.size)
+		if remain <= int64(c.buf.Len()) {
+			if c.skip(int(remain), 0) {
+				c.buf.Next(int(remain))
+				c.off += remain
+				c.frame = -1
+				continue
+			}
+			c.setFound(int(remain), 0)
+			return nil
+		}
+		if c.ierr != nil && c.buf.Len() == 0 {
+			return c.truncated()
+		}
+		c.scan = c.buf.Len()
+		return nil
+	}
+}
+
+// skip reports whether a key of length n found at pos ends a chunk that is to
+// be skipped.  Only chunks that have not been partly delivered are skipped.
+func (c *Reader) skip(pos, n int) bool {
+	if c.skipLead && c.off == 0 && pos == 0 && n > 0 {
+		return true
+	}
+	min := c.minSize
+	if c.skipEmpty && min < 1 {
+		min = 1
+	}
+	if c.keep {
+		pos += n
+	}
+	return c.size == 0 && pos < min
+}
+
+// setFound records a key of length n found at pos in the buffer.
+func (c *Reader) setFound(pos, n int) {
+	c.scan = pos
+	c.found = true
+	c.drop = n
+	if c.keep {
+		c.scan += c.drop
+		c.drop = 0
+	}
+}
+
+// Read implements the standard Reader interface allowing chunkio to be used
+// anywhere a standard Reader can be used.  Read puts data into p.  It returns
+// the number of bytes read into p.  The bytes are taken from at most one read
+// on the underlying Reader, hence n may be less than len(p), but all the data
+// of the chunk found in the buffer ahead of the key is delivered at once if p
+// is large enough.  When the key is reached (EOF for the stream chunk), the
+// count will be zero and err will be io.EOF.  If the stream ends before the
+// key, the remaining data is returned followed by ErrKeyNotFound, or by the
+// error of the underlying Reader if it failed with an error other than
+// io.EOF.  An underlying Reader returning no data and no error 100 times in a
+// row fails with io.ErrNoProgress.  If the key has been set to nil, the Read
+// function performs exactly like the underlying stream Read function (no key
+// scanning).
+func (c *Reader) Read(p []byte) (int, error) {
+	defer c.lock()()
+	return c.read(p)
+}
+
+// read is Read for a Reader that is already locked.
+func (c *Reader) read(p []byte) (n int, err error) {
+	if c.trace != nil {
+		defer func() { c.traceRead(n, err) }()
+	}
+	c.last = -1
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.raw() {
+		return c.readRaw(p)
+	}
+	if len(c.decoded) > 0 {
+		return c.readDecoded(p)
+	}
+	if c.scan == 0 && !c.found {
+		if err := c.search(); err != nil {
+			return 0, err
+		}
+	}
+	if c.scan > 0 {
+		n, err := c.readScanned(p)
+		if c.eagerEOF && err == nil && c.scan == 0 && c.found && len(c.decoded) == 0 {
+			_, err = c.readEOF()
+		}
+		return n, err
+	}
+	return c.readEOF()
+}
+
+// ReadContext is like Read but gives up waiting on the underlying Reader once
+// ctx is done, returning ctx.Err().  An abandoned read of the underlying
+// Reader keeps running in the background.  The data it returns is kept and
+// delivered by later reads, but the underlying Reader cannot be used directly
+// until that read completes.
+func (c *Reader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	defer c.lock()()
+	c.ctx = ctx
+	defer func() { c.ctx = nil }()
+	return c.read(p)
+}
+
+// ReadByte implements the io.ByteReader interface.  It reads a single byte from
+// the chunk, returning io.EOF once the key is reached.
+func (c *Reader) ReadByte() (byte, error) {
+	defer c.lock()()
+	if c.raw() && c.buf.Len() == 0 && c.err == nil {
+		// Read through the buffer so that UnreadByte can step back
+		if err := c.bufFill(); err != nil {
+			return 0, err
+		}
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(unlocked{c}, b[:]); err != nil {
+		return 0, err
+	}
+	c.last = int(b[0])
+	// Unless the chunk ended or the byte was decoded, nothing was taken from
+	// the buffer after it
+	c.lastBuf = c.raw() || c.err == nil && c.esc == nil && c.decode == nil
+	return b[0], nil
+}
+
+// Discard skips the next n bytes of the chunk, returning the number of bytes
+// discarded.  If Discard skips fewer than n bytes, it also returns an error
+// explaining why: io.EOF if the key is reached, ErrKeyNotFound if the stream
+// ended without the key, or any other error encountered.  Buffered data is
+// skipped without being copied.
+func (c *Reader) Discard(n int) (discarded int, err error) {
+	defer c.lock()()
+	c.last = -1
+	if n < 0 {
+		return 0, ErrNegativeCount
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if (c.esc != nil || c.decode != nil) && !c.raw() {
+		m, err := io.CopyN(io.Discard, unlocked{c}, int64(n))
+		return int(m), err
+	}
+	for discarded < n {
+		var m int
+		if c.raw() {
+			if c.buf.Len() == 0 {
+				if err := c.bufFill(); err != nil {
+					return discarded, err
+				}
+				if c.buf.Len() == 0 {
+					return discarded, c.ierr
+				}
+			}
+			m = c.buf.Len()
+			if m > n-discarded {
+				m = n - discarded
+			}
+			if m, err = c.total(m); err != nil {
+				return discarded, err
+			}
+			c.hashData(c.buf.Next(m))
+			c.off += int64(m)
+			discarded += m
+			continue
+		}
+		if c.scan == 0 && !c.found {
+			if err := c.search(); err != nil {
+				return discarded, err
+			}
+		}
+		if c.scan == 0 {
+			_, err := c.readEOF()
+			return discarded, err
+		}
+		if m, err = c.limit(); err != nil {
+			return discarded, err
+		}
+		if m > n-discarded {
+			m = n - discarded
+		}
+		c.next(m)
+		discarded += m
+	}
+	return discarded, nil
+}
+
+// UnreadByte unreads the last byte.  Only the most recently read byte can be
+// unread, and only if it was read with ReadByte.  A byte decoded with
+// SetUnescape or SetChunkDecoder cannot be unread, nor can the last byte of a
+// chunk once SetEagerEOF has ended it.  ErrInvalidUnreadByte is returned in
+// those cases.
+func (c *Reader) UnreadByte() error {
+	defer c.lock()()
+	if c.last < 0 || !c.lastBuf {
+		return ErrInvalidUnreadByte
+	}
+	if c.buf.UnreadByte() != nil {
+		c.unread([]byte{byte(c.last)})
+	}
+	c.off--
+	c.unhashed++
+	if len(c.kept) > 0 {
+		c.kept = c.kept[:len(c.kept)-1]
+	}
+	if !c.raw() {
+		c.scan++
+	}
+	c.last = -1
+	return nil
+}
+
+// UnreadChunk pushes chunk back in front of the remaining data, followed by the
+// key, so that the next chunk read is chunk again.  It can be used once the
+// current chunk has been read to the key, or before any of it has been read,
+// for instance right after Reset.  The key appended is the one that ended the
+// last chunk, see MatchedKey, or the key set by SetKey if no key has been found
+// yet.  In length prefixed mode a prefix is added instead, and with SetKeepKey
+// chunk is expected to end with its key already.  Escape sequences are added
+// as needed when SetUnescape is in effect.  The Reader is Reset, and Offset and
+// ChunkCount are moved back.  ErrInvalidUnreadChunk is returned if part of the
+// current chunk has been read, if no key is set, or if no key is known for
+// SetKeyRegexp or SetKeyFunc.
+func (c *Reader) UnreadChunk(chunk []byte) error {
+	defer c.lock()()
+	end := c.err == nil || c.err == ErrKeyNotFound && c.ierr == io.EOF
+	if c.raw() || c.frameSkip > 0 || !(c.err == io.EOF || end && c.size == 0) {
+		return ErrInvalidUnreadChunk
+	}
+	var b []byte
+	if c.prefix > 0 {
+		h, ok := c.header(len(chunk))
+		if !ok {
+			return ErrInvalidUnreadChunk
+		}
+		b = append(h, chunk...)
+		if c.err == nil && c.frame >= 0 {
+			// The prefix of the current frame has already been read
+			h, _ := c.header(int(c.frame))
+			b = append(b, h...)
+		}
+	} else {
+		key := c.match
+		if key == nil {
+			key = c.key
+		}
+		if key == nil {
+			return ErrInvalidUnreadChunk
+		}
+		if c.esc != nil {
+			chunk = escape(chunk, c.esc, key[0])
+		}
+		if c.bracket() {
+			b = append(b, c.start...)
+		}
+		b = append(b, chunk...)
+		if !c.keep {
+			b = append(b, key...)
+		}
+		if c.bracket() && c.inside && c.err == nil {
+			// The start marker of the current chunk has already been read
+			b = append(b, c.start...)
+		}
+		c.inside = false
+		c.selected = false
+	}
+	if c.err == io.EOF && c.chunks > 0 {
+		c.chunks--
+	}
+	c.unread(b)
+	c.off -= int64(len(b))
+	c.checked = c.off
+	c.err = nil
+	c.frame = -1
+	c.drop = 0
+	c.scan = 0
+	c.found = false
+	c.last = -1
+	c.size = 0
+	return nil
+}
+
+// header returns the length prefix of a frame of n bytes and whether n fits in
+// the prefix.
+func (c *Reader) header(n int) ([]byte, bool) {
+	b := make([]byte, 8)
+	switch c.prefix {
+	case 1:
+		b[0] = byte(n)
+		return b[:1], n < 1<<8
+	case 2:
+		c.order.PutUint16(b, uint16(n))
+		return b[:2], n < 1<<16
+	case 4:
+		c.order.PutUint32(b, uint32(n))
+		return b[:4], uint64(n) < 1<<32
+	}
+	c.order.PutUint64(b, uint64(n))
+	return b, true
+}
+
+// unread pushes p back to the front of the buffer.
+func (c *Reader) unread(p []byte) {
+	b := make([]byte, 0, len(p)+c.buf.Len())
+	b = append(append(b, p...), c.buf.Bytes()...)
+	c.buf.Reset()
+	c.buf.Write(b)
+}
+
+// ReadRune implements the io.RuneReader interface.  It reads a single UTF-8
+// encoded rune from the chunk, returning io.EOF once the key is reached.  A
+// rune is never decoded across the key, so an incomplete encoding just before
+// the key or the end of the stream is returned as utf8.RuneError with a size
+// of 1.
+func (c *Reader) ReadRune() (r rune, size int, err error) {
+	defer c.lock()()
+	c.last = -1
+	if c.err != nil {
+		return 0, 0, c.err
+	}
+	if c.raw() {
+		if !utf8.FullRune(c.buf.Bytes()) {
+			if err := c.bufFill(); err != nil {
+				return 0, 0, err
+			}
+		}
+		if c.buf.Len() == 0 {
+			return 0, 0, c.ierr
+		}
+		r, size = utf8.DecodeRune(c.buf.Bytes())
+		if n, err := c.total(size); err != nil {
+			return 0, 0, err
+		} else if n < size {
+			c.err = ErrMaxTotalExceeded
+			return 0, 0, c.err
+		}
+		c.hashData(c.buf.Next(size))
+		c.off += int64(size)
+		return r, size, nil
+	}
+	need := utf8.UTFMax
+	if c.esc != nil {
+		need *= len(c.esc) + 1
+	}
+	if !c.found && (c.scan == 0 || c.scan < need && c.ierr == nil) {
+		// Searching again moves scan forward to cover more of the buffer
+		if err := c.search(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if c.scan == 0 {
+		_, err = c.readEOF()
+		return 0, 0, err
+	}
+	src := c.buf.Bytes()[:c.scan]
+	used := 0
+	var b [utf8.UTFMax]byte
+	if c.esc != nil {
+		end := c.found || c.ierr != nil
+		k, _ := unescape(b[:], src, c.esc, end)
+		if k == 0 {
+			c.err = ErrBufferFull
+			return 0, 0, c.err
+		}
+		r, size = utf8.DecodeRune(b[:k])
+		_, used = unescape(b[:size], src, c.esc, end)
+	} else {
+		r, size = utf8.DecodeRune(src)
+		used = size
+	}
+	if n, err := c.limit(); err != nil {
+		return 0, 0, err
+	} else if used > n {
+		return 0, 0, c.overLimit(used)
+	}
+	if c.esc != nil {
+		c.next(used)
+		c.hashData(b[:size])
+		c.retainData(b[:size])
+	} else {
+		c.retainData(c.next(used))
+	}
+	return r, size, nil
+}
+
+// WriteTo implements the io.WriterTo interface.  It writes the remainder of the
+// current chunk directly from the internal buffer to w, stopping at the key.
+// The returned error is nil if the key was found, ErrKeyNotFound if the
+// stream ended before the key, or any error encountered while writing.  A
+// truncated final chunk can therefore be told apart from a complete one, even
+// though io.Copy uses WriteTo and returns its error.  If the key has been set
+// to nil the rest of the stream is written.
+func (c *Reader) WriteTo(w io.Writer) (int64, error) {
+	defer c.lock()()
+	return c.writeTo(w)
+}
+
+// writeTo is WriteTo for a Reader that is already locked.
+func (c *Reader) writeTo(w io.Writer) (int64, error) {
+	var written int64
+
+	c.last = -1
+	if c.err == io.EOF {
+		return 0, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.raw() {
+		for {
+			n, err := c.writeRaw(w)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if c.ierr == io.EOF {
+				return written, nil
+			}
+			if c.ierr != nil {
+				return written, c.ierr
+			}
+			abort, err := c.readOnce(c.bufSize)
+			if abort != nil {
+				return written, abort
+			}
+			c.ierr = err
+		}
+	}
+	if c.esc != nil || c.transform != nil || c.decode != nil {
+		// Decoding or transforming needs a buffer besides the internal one
+		return io.Copy(w, unlocked{c})
+	}
+	for {
+		if c.scan == 0 && !c.found {
+			if err := c.search(); err == io.EOF {
+				// The end of the stream ended the chunk, see SetEOFTerminates
+				return written, nil
+			} else if err != nil {
+				return written, err
+			}
+		}
+		if c.scan == 0 {
+			c.readEOF()
+			return written, nil
+		}
+		n, err := c.limit()
+		if err == io.EOF {
+			// The chunk limit ended the chunk, see SetChunkLimit
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+		b := c.buf.Bytes()[:n]
+		n, err = w.Write(b)
+		c.retainData(c.next(n))
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if n < len(b) {
+			return written, io.ErrShortWrite
+		}
+	}
+}
+
+// WriteChunksTo writes up to n chunks to w like WriteTo, starting with the rest
+// of the current chunk, with sep written between them in place of the keys.
+// The Reader is Reset after each chunk that ends with the key, leaving it at
+// the start of the next chunk, so writing can be resumed by another call.  It
+// stops early without error when the stream is exhausted.  The returned error
+// is ErrKeyNotFound if data at the end of the stream not followed by the key
+// was written as the last chunk, or any error encountered while reading or
+// writing.  If the key has been set to nil the rest of the stream is written
+// as a single chunk.
+func (c *Reader) WriteChunksTo(w io.Writer, n int, sep []byte) (int64, error) {
+	defer c.lock()()
+	var written int64
+	if c.err == io.EOF {
+		c.reset()
+	}
+	for i := 0; i < n; i++ {
+		if c.err == nil && !c.raw() && c.scan == 0 && !c.found {
+			// Find out whether there is another chunk before writing sep
+			if err := c.search(); err != nil && err != ErrKeyNotFound {
+				return written, err
+			}
+		}
+		if c.err == ErrKeyNotFound && c.size == 0 {
+			return written, nil
+		}
+		if i > 0 {
+			m, err := w.Write(sep)
+			written += int64(m)
+			if err == nil && m < len(sep) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+		m, err := c.writeTo(w)
+		written += m
+		if err != nil || c.raw() {
+			return written, err
+		}
+		c.reset()
+	}
+	return written, nil
+}
+
+// writeRaw writes the buffered data to w for WriteTo when no key is set.
+func (c *Reader) writeRaw(w io.Writer) (int64, error) {
+	n, err := c.total(c.buf.Len())
+	if err != nil {
+		return 0, err
+	}
+	m, err := w.Write(c.buf.Bytes()[:n])
+	c.hashData(c.buf.Next(m))
+	c.off += int64(m)
+	if err == nil && m < n {
+		err = io.ErrShortWrite
+	}
+	return int64(m), err
+}
+
+// Close closes the underlying Reader if it implements io.Closer and returns its
+// error, otherwise it returns nil.  Any buffered data is discarded and all
+// further reads return ErrClosed.
+func (c *Reader) Close() error {
+	defer c.lock()()
+	if c.err == ErrClosed {
+		return ErrClosed
+	}
+	c.err = ErrClosed
+	c.buf.Reset()
+	c.scan = 0
+	c.found = false
+	if rc, ok := c.rd.(io.Closer); ok {
+		return rc.Close()
+	}
+	return nil
+}
+
+// SkipChunk discards the remainder of the current chunk, leaving the Reader in
+// the same state as reading the chunk to the end.  The returned error is nil
+// if the key was found and ErrKeyNotFound if the stream ended first.
+func (c *Reader) SkipChunk() error {
+	defer c.lock()()
+	_, err := c.writeTo(io.Discard)
+	return err
+}
+
+// SeekToChunk positions the Reader at the start of chunk n of the stream,
+// counting from zero.  The underlying Reader must implement io.Seeker, otherwise
+// ErrNotSeekable is returned.  It is rewound to the start of the stream, all
+// buffered data and chunk state is discarded, and the first n chunks are
+// skipped, so ChunkCount returns n afterwards.  The keys and settings of the
+// Reader are kept.  ErrNoChunk is returned if fewer than n chunks end with a
+// key.
+func (c *Reader) SeekToChunk(n int) error {
+	if n < 0 {
+		return ErrNegativeCount
+	}
+	defer c.lock()()
+	if err := c.seek(0); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		_, err := c.writeTo(io.Discard)
+		if err == ErrKeyNotFound || err == nil && c.raw() {
+			return ErrNoChunk
+		}
+		if err != nil {
+			return err
+		}
+		c.reset()
+	}
+	return nil
+}
+
+// BuildIndex scans the whole stream from the start and returns the offset of
+// the first byte of each chunk, for use with SeekIndexed.  Like SeekToChunk it
+// requires the underlying Reader to implement io.Seeker and rewinds it first.
+// The stream is consumed, leaving the Reader at its end.  Data after the last
+// key is indexed as a final chunk if it is not empty.
+func (c *Reader) BuildIndex() ([]int64, error) {
+	defer c.lock()()
+	if err := c.seek(0); err != nil {
+		return nil, err
+	}
+	var idx []int64
+	for {
+		start := c.off
+		_, err := c.writeTo(io.Discard)
+		if err == ErrKeyNotFound && c.off > start || err == nil {
+			idx = append(idx, start)
+		}
+		if err == ErrKeyNotFound || err == nil && c.raw() {
+			return idx, nil
+		}
+		if err != nil {
+			return idx, err
+		}
+		c.reset()
+	}
+}
+
+// Analyze scans the stream to its end and returns statistics on its chunks,
+// to check the shape of an input before processing it.  Like BuildIndex, it
+// counts data after the last key as a final chunk if it is not empty.  If the
+// underlying Reader implements io.Seeker it is moved to its start, offset 0,
+// before and after the scan, leaving the Reader at the start of the stream
+// with its chunk state discarded.  Otherwise the chunks are counted from the
+// current position and the stream is consumed.  On an error other than the end
+// of the stream, the statistics gathered so far are returned with it.
+func (c *Reader) Analyze() (ChunkioStats, error) {
+	defer c.lock()()
+	var s ChunkioStats
+	_, seekable := c.rd.(io.Seeker)
+	if seekable {
+		if err := c.seek(0); err != nil {
+			return s, err
+		}
+	}
+	for {
+		n, err := c.writeTo(io.Discard)
+		terminated := err == nil && !c.raw()
+		if terminated || n > 0 && (err == nil || err == ErrKeyNotFound) {
+			if s.Count == 0 || n < s.MinSize {
+				s.MinSize = n
+			}
+			s.MaxSize = max(s.MaxSize, n)
+			s.TotalBytes += n
+			s.Count++
+			s.FinalTerminated = terminated
+		}
+		if err == ErrKeyNotFound || err == nil && !terminated {
+			break
+		}
+		if err != nil {
+			return s, err
+		}
+		c.reset()
+	}
+	if seekable {
+		return s, c.seek(0)
+	}
+	return s, nil
+}
+
+// SeekIndexed positions the Reader at the start of chunk n using an index
+// returned by BuildIndex for the same stream and keys.  The underlying Reader
+// is moved directly to the chunk without scanning the chunks before it.  The
+// state of the Reader is set up as by SeekToChunk.  ErrNoChunk is returned if
+// n is not in idx.
+func (c *Reader) SeekIndexed(idx []int64, n int) error {
+	defer c.lock()()
+	if n < 0 || n >= len(idx) {
+		return ErrNoChunk
+	}
+	if err := c.seek(idx[n]); err != nil {
+		return err
+	}
+	c.chunks = n
+	return nil
+}
+
+// LastChunks returns the last n chunks of the stream, the last one first, as
+// for tailing a log.  Like SeekToChunk it requires the underlying Reader to
+// implement io.Seeker, but rather than reading the whole stream it scans it
+// backward from the end, one read ahead size at a time, until n chunks are
+// found.  Data after the last key is returned as the last chunk if it is not
+// empty.  Fewer than n chunks are returned if the stream does not have as many.
+// Only keys set with SetKey, SetKeys or their variants are supported, otherwise
+// ErrInvalidKey is returned, and the chunks are returned as stored in the
+// stream, without decoding or transforming them.  For keys that can overlap
+// themselves, such as "aa", the chunks may differ from those read forward.
+// The Reader is left at the end of the stream with all chunk state discarded.
+func (c *Reader) LastChunks(n int) ([][]byte, error) {
+	if n < 0 {
+		return nil, ErrNegativeCount
+	}
+	defer c.lock()()
+	if c.keys == nil || c.split != nil || c.prefix > 0 || c.selector != nil || c.start != nil {
+		return nil, ErrInvalidKey
+	}
+	if err := c.seek(0); err != nil {
+		return nil, err
+	}
+	size, err := c.rd.(io.Seeker).Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	// Collect the positions of the keys, the last one first.  Each window is
+	// followed by the start of the next one so that a key across the
+	// boundary is found.
+	var starts, ends []int64
+	limit := size
+	var next []byte
+	for pos := size; pos > 0 && len(starts) <= n; {
+		w := int(min(int64(c.bufAdd), pos))
+		pos -= int64(w)
+		b := make([]byte, w+len(next))
+		if err := c.readAt(b[:w], pos); err != nil {
+			return nil, err
+		}
+		copy(b[w:], next)
+		var found []int
+		for from := 0; from < w; {
+			p, k := c.indexFrom(b, from)
+			if k == 0 || p >= w {
+				break
+			}
+			if pos+int64(p+k) <= limit {
+				found = append(found, p, p+k)
+			}
+			from = p + k
+		}
+		for i := len(found) - 2; i >= 0; i -= 2 {
+			starts = append(starts, pos+int64(found[i]))
+			ends = append(ends, pos+int64(found[i+1]))
+		}
+		if len(found) > 0 {
+			limit = pos + int64(found[0])
+		}
+		next = b[:min(c.maxKey-1, len(b))]
+	}
+	var chunks [][]byte
+	read := func(from, to int64) error {
+		b := make([]byte, to-from)
+		if err := c.readAt(b, from); err != nil {
+			return err
+		}
+		chunks = append(chunks, b)
+		return nil
+	}
+	last := int64(0)
+	if len(ends) > 0 {
+		last = ends[0]
+	}
+	if last < size && n > 0 {
+		if err := read(last, size); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < len(starts) && len(chunks) < n; i++ {
+		from := int64(0)
+		if i+1 < len(ends) {
+			from = ends[i+1]
+		}
+		if err := read(from, starts[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.seek(size); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// indexFrom returns the position and length of the earliest key in b at or
+// after from, or a length of 0 if there is none.
+func (c *Reader) indexFrom(b []byte, from int) (int, int) {
+	pos, n := -1, 0
+	for i, key := range c.keys {
+		lim := b
+		if e := pos + len(key) - 1; pos >= 0 && e < len(b) {
+			// Only a match starting before pos is of interest
+			lim = b[:e]
+		}
+		if from > len(lim) {
+			continue
+		}
+		if p := c.find(lim[from:], i); p >= 0 {
+			pos = from + p
+			n = len(key)
+		}
+	}
+	return pos, n
+}
+
+// readAt fills b with the data of the underlying Reader at offset off.
+func (c *Reader) readAt(b []byte, off int64) error {
+	defer c.unlockIO()()
+	if _, err := c.rd.(io.Seeker).Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(c.rd, b)
+	return err
+}
+
+// seek moves the underlying Reader to offset off of the stream and discards all
+// buffered data and chunk state.  A failed write to the tee stays in effect.
+func (c *Reader) seek(off int64) error {
+	if c.err == ErrClosed {
+		return ErrClosed
+	}
+	s, ok := c.rd.(io.Seeker)
+	if !ok {
+		return ErrNotSeekable
+	}
+	if c.pending != nil {
+		<-c.pending
+		c.pending = nil
+	}
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	c.clear(off)
+	return nil
+}
+
+// clear discards all buffered data and chunk state, leaving the Reader at
+// offset off of the stream.
+func (c *Reader) clear(off int64) {
+	c.buf.Reset()
+	c.err = c.terr
+	c.ierr = c.terr
+	c.match = nil
+	c.matched = -1
+	c.keyOff = -1
+	c.mtail = c.mtail[:0]
+	c.decoded = nil
+	c.drop = 0
+	c.scan = 0
+	c.found = false
+	c.last = -1
+	c.off = off
+	c.chunks = 0
+	c.size = 0
+	c.checked = off
+	c.complete = false
+	c.frame = -1
+	c.frameSkip = 0
+	c.inside = false
+	c.selected = false
+	c.kept = c.kept[:0]
+	c.unhashed = 0
+	c.empty = 0
+	if c.hash != nil {
+		c.hash.Reset()
+	}
+}
+
+// Chunks returns an iterator over the chunks of the stream, starting with the
+// current chunk.  Each chunk is read to the key, yielded with a nil error, and
+// the Reader is Reset for the next one.  Iteration stops when the stream is
+// exhausted.  Data at the end of the stream that is not followed by the key is
+// yielded with ErrKeyNotFound, and any other error is yielded with the
+// data read before it, ending the iteration.  Each yielded slice is newly
+// allocated and is not reused.
+func (c *Reader) Chunks() iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		for {
+			b, err := c.chunk()
+			switch {
+			case err == nil:
+				if !yield(b, nil) {
+					return
+				}
+			case err == ErrKeyNotFound && len(b) == 0:
+				return
+			default:
+				yield(b, err)
+				return
+			}
+		}
+	}
+}
+
+// chunk reads the current chunk for Chunks and Resets the Reader if the chunk
+// ended with the key.  The Reader is not locked while Chunks yields.
+func (c *Reader) chunk() ([]byte, error) {
+	defer c.lock()()
+	b, err := c.readChunk()
+	if err == nil {
+		c.reset()
+	}
+	return b, err
+}
+
+// NextChunk returns an io.Reader that reads only the current chunk, for passing
+// the chunk to code that reads to io.EOF.  If the current chunk has already
+// been read to the key, the Reader is Reset first so the returned Reader reads
+// the next chunk.  The returned Reader shares the state of the Reader: it
+// returns io.EOF at the key, after which the Reader must be Reset, or NextChunk
+// called again, to continue with the following chunk.  A chunk that is only
+// partly read is continued by the next read of either Reader.
+func (c *Reader) NextChunk() io.Reader {
+	defer c.lock()()
+	if c.err == io.EOF {
+		c.reset()
+	}
+	return chunkView{c}
+}
+
+// chunkView is the io.Reader returned by NextChunk.  It hides the other methods
+// of Reader from the code reading the chunk.
+type chunkView struct {
+	c *Reader
+}
+
+func (v chunkView) Read(p []byte) (int, error) {
+	return v.c.Read(p)
+}
+
+func (v chunkView) WriteTo(w io.Writer) (int64, error) {
+	return v.c.WriteTo(w)
+}
+
+// ForEachChunk calls fn with each remaining chunk of the stream, starting with
+// the current chunk, and Resets the Reader after each one.  It stops when the
+// stream is exhausted and returns nil, or when fn or reading a chunk fails and
+// returns that error.  Data at the end of the stream that is not followed by
+// the key is passed to fn as a final chunk, during which Complete returns
+// false.  The chunk passed to fn is newly allocated and may be retained.
+func (c *Reader) ForEachChunk(fn func(chunk []byte) error) error {
+	for b, err := range c.Chunks() {
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadAllChunks reads the remaining chunks of the stream, starting with the
+// current chunk, and returns them as separately allocated slices.  The returned
+// error is nil if the last chunk ended with the key and ErrKeyNotFound if
+// the stream ended before the key, in which case the data after the last key is
+// included as the final chunk.  Any other error, such as ErrChunkTooLarge when
+// a maximum chunk size is set, stops reading and is returned along with the
+// complete chunks read before it.
+func (c *Reader) ReadAllChunks() ([][]byte, error) {
+	var chunks [][]byte
+	for b, err := range c.Chunks() {
+		if err != nil && err != ErrKeyNotFound {
+			return chunks, err
+		}
+		chunks = append(chunks, b)
+		if err != nil {
+			return chunks, err
+		}
+	}
+	return chunks, nil
+}
+
+// ReadChunk reads until the key is reached and returns the data read.  The
+// returned error is nil if the key was found, ErrKeyNotFound if the stream
+// ended before the key, or any other error encountered.  The Reader is not
+// Reset, so the next chunk is only available after calling Reset.
+func (c *Reader) ReadChunk() ([]byte, error) {
+	defer c.lock()()
+	return c.readChunk()
+}
+
+// readChunk is ReadChunk for a Reader that is already locked.
+func (c *Reader) readChunk() ([]byte, error) {
+	var b bytes.Buffer
+	_, err := b.ReadFrom(unlocked{c})
+	return b.Bytes(), err
+}
+
+// ChunkWithKey sets the key like SetKey and reads the current chunk like
+// ReadChunk.  If the chunk ended with the key the Reader is Reset, so the next
+// call reads the following chunk, with the same or another key.  The error of
+// SetKey is returned if key is invalid, with nothing read.
+func (c *Reader) ChunkWithKey(key []byte) ([]byte, error) {
+	defer c.lock()()
+	if err := c.setKey(key); err != nil {
+		return nil, err
+	}
+	b, err := c.readChunk()
+	if err == nil {
+		c.reset()
+	}
+	return b, err
+}
+
+// ReadChunkInto reads the current chunk into dst, so that a single buffer can
+// be reused for all chunks.  It returns the number of bytes read and whether
+// the end of the chunk was reached, which is false if dst was too small to
+// hold the rest of the chunk.  The rest is then read by the following calls.
+// The returned error is nil if the key was found or the end of the chunk was
+// not reached, ErrKeyNotFound if the stream ended before the key, or any other
+// error encountered.  As with ReadChunk, the Reader is not Reset.
+func (c *Reader) ReadChunkInto(dst []byte) (int, bool, error) {
+	defer c.lock()()
+	n := 0
+	var err error
+	for n < len(dst) && err == nil {
+		var m int
+		m, err = c.read(dst[n:])
+		n += m
+	}
+	if err == nil && !c.raw() {
+		// Look ahead for the key in case the chunk fits dst exactly
+		err = c.err
+		if err == nil && c.scan == 0 && !c.found {
+			err = c.search()
+		}
+		if err == nil && c.scan == 0 && c.found && len(c.decoded) == 0 {
+			_, err = c.readEOF()
+		}
+	}
+	switch err {
+	case nil:
+		return n, false, nil
+	case io.EOF:
+		return n, true, nil
+	case ErrKeyNotFound:
+		return n, true, err
+	}
+	return n, false, err
+}
+
+// ReadString is like ReadChunk but returns the data read as a string.  The data
+// is written directly from the internal buffer to a strings.Builder, avoiding a
+// copy when converting it to a string.
+func (c *Reader) ReadString() (string, error) {
+	defer c.lock()()
+	var b strings.Builder
+	_, err := c.writeTo(&b)
+	return b.String(), err
+}
+
+// Peek returns the next n bytes of the chunk without advancing the reader.  The
+// bytes stop being valid at the next read call.  If Peek returns fewer than n
+// bytes, it also returns an error explaining why the read is short: io.EOF if
+// the key is reached, ErrKeyNotFound if the stream ended without the key,
+// or ErrBufferFull if n is larger than what the buffer can hold ahead of the
+// key.
+func (c *Reader) Peek(n int) ([]byte, error) {
+	defer c.lock()()
+	if n < 0 {
+		return nil, ErrNegativeCount
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	var avail int
+	if c.raw() {
+		if c.buf.Len() < n {
+			if err := c.bufFill(); err != nil {
+				return nil, err
+			}
+		}
+		avail = c.buf.Len()
+	} else {
+		if c.scan == 0 && !c.found {
+			if err := c.search(); err != nil {
+				return nil, err
+			}
+		}
+		avail = c.scan
+	}
+	b := c.buf.Bytes()[:avail]
+	if c.esc != nil && !c.raw() {
+		if cap(c.tmp) < avail {
+			c.tmp = make([]byte, avail)
+		}
+		k, _ := unescape(c.tmp[:avail], b, c.esc, c.found || c.ierr != nil)
+		b = c.tmp[:k]
+	}
+	if n <= len(b) {
+		return b[:n], nil
+	}
+	var err error
+	switch {
+	case c.found:
+		err = io.EOF
+	case c.raw() && c.ierr != nil:
+		err = c.ierr
+	case c.ierr != nil:
+		err = c.eofErr()
+	default:
+		err = ErrBufferFull
+	}
+	return b, err
+}
+
+// PeekChunk returns the rest of the current chunk without advancing the reader,
+// and whether the key follows it.  The buffer is filled as needed to look for
+// the key, and the returned bytes are those of the buffer up to the key, so
+// they stop being valid at the next read call.  If the chunk does not fit in
+// the buffer, or the stream ended without the key, only the data buffered so
+// far is returned, with false, and the chunk can be read as usual instead.
+// The buffer can be allowed to grow to hold larger chunks with SetMaxPeek.  The
+// transform of SetTransform is not applied.  Without a key the buffered data is
+// returned with false.
+func (c *Reader) PeekChunk() ([]byte, bool, error) {
+	defer c.lock()()
+	if c.err != nil {
+		return nil, false, c.err
+	}
+	if c.raw() {
+		if err := c.bufFill(); err != nil {
+			return nil, false, err
+		}
+		return c.buf.Bytes(), false, nil
+	}
+	if !c.found {
+		if err := c.search(); err != nil {
+			return nil, false, err
+		}
+	}
+	n := c.maxPeek
+	if c.maxSize > 0 && n > c.maxSize-c.size {
+		n = c.maxSize - c.size
+	}
+	if !c.found && c.ierr == nil && n > c.bufAdd {
+		// Grow the buffer to look for the key further ahead
+		size := c.bufSize
+		c.bufSize = n + c.maxKey
+		err := c.search()
+		c.bufSize = size
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	b := c.buf.Bytes()[:c.scan]
+	if c.esc != nil {
+		if cap(c.tmp) < len(b) {
+			c.tmp = make([]byte, len(b))
+		}
+		k, _ := unescape(c.tmp[:len(b)], b, c.esc, c.found || c.ierr != nil)
+		b = c.tmp[:k]
+	}
+	return b, c.found, nil
+}
+
+// SetMaxPeek lets PeekChunk grow the buffer beyond the read ahead size so
+// that chunks of up to n bytes are returned whole.  The buffer is only grown
+// while looking for the key of a chunk that does not fit in the read ahead
+// size, after which later reads fill it to the read ahead size again, so n
+// bounds the memory used.  Chunk data past n bytes is not looked at and
+// PeekChunk returns false for it, as it does for chunks longer than the
+// maximum chunk size set by SetMaxChunkSize, which further limits n.  A value
+// of 0, the default, or less than the read ahead size, see BufSize, leaves the
+// buffer at its usual size.
+func (c *Reader) SetMaxPeek(n int) {
+	defer c.lock()()
+	c.maxPeek = n
+}
+
+// ChunkLen returns the number of bytes left to read in the current chunk, and
+// whether the end of the chunk has been located.  The buffer is filled as
+// needed to look for the key, but nothing is read.  If the key is not within
+// the buffer, or the stream ended without it, the length is only that of the
+// data known to be part of the chunk so far and false is returned.  In length
+// prefixed mode the length comes from the prefix and true is returned once the
+// prefix is read.  Without a key the buffered data is reported with false.
+func (c *Reader) ChunkLen() (int, bool) {
+	defer c.lock()()
+	if c.err != nil {
+		return 0, c.err == io.EOF
+	}
+	if c.raw() {
+		if c.bufFill() != nil {
+			return 0, false
+		}
+		return c.buf.Len(), false
+	}
+	if !c.found && c.search() != nil {
+		return 0, false
+	}
+	if c.prefix > 0 {
+		return int(c.frame) - c.size, true
+	}
+	n := c.scan
+	if c.esc != nil {
+		if cap(c.tmp) < n {
+			c.tmp = make([]byte, n)
+		}
+		n, _ = unescape(c.tmp[:n], c.buf.Bytes()[:n], c.esc, c.found || c.ierr != nil)
+	}
+	return n, c.found
 }
@@ -0,0 +1,50 @@
+// Copyright (c) 2019 Jason T. Lenz.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package chunkio
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Test that indexBMH agrees with bytes.Index on random data with a small
+// alphabet, so partial matches are frequent.
+func TestIndexBMH(t *testing.T) {
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, rand.Intn(200))
+		for j := range b {
+			b[j] = byte('a' + rand.Intn(3))
+		}
+		key := make([]byte, rand.Intn(12)+1)
+		for j := range key {
+			key[j] = byte('a' + rand.Intn(3))
+		}
+		if want, got := bytes.Index(b, key), indexBMH(b, key, skipTable(key)); want != got {
+			t.Errorf("indexBMH(%q, %q). Expected %d, got %d", b, key, want, got)
+		}
+	}
+}
+
+func benchmarkIndexLongKey(b *testing.B, index func(b, key []byte) int) {
+	buf := make([]byte, 1<<20)
+	rand.Read(buf)
+	key := make([]byte, 64)
+	rand.Read(key)
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		index(buf, key)
+	}
+}
+
+func BenchmarkIndexLongKeyBMH(b *testing.B) {
+	benchmarkIndexLongKey(b, func(buf, key []byte) int {
+		return indexBMH(buf, key, skipTable(key))
+	})
+}
+
+func BenchmarkIndexLongKeyBytes(b *testing.B) {
+	benchmarkIndexLongKey(b, bytes.Index)
+}
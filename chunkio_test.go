@@ -6,16 +6,27 @@ package chunkio_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"regexp"
 	"git.lenzplace.org/lenzj/chunkio"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
 )
 
-func ExampleUppercase() {
+func Example_uppercase() {
 	example := []byte("the quick {U}brown fox jumps{L} over the lazy dog")
 	cio := chunkio.NewReader(bytes.NewReader(example))
 	cio.SetKey([]byte("{U}"))
@@ -46,6 +57,33 @@ func TestShortNewReader(t *testing.T) {
 	}
 }
 
+func TestShortNewReaderSize(t *testing.T) {
+	in := append(bytes.Repeat([]byte("0123456789"), 100), []byte("{END}trailer")...)
+	for _, size := range []int{-1, 0, 1, 16, 100, 8192} {
+		c := chunkio.NewReaderSize(bytes.NewReader(in), size)
+		c.SetKey([]byte("{END}"))
+		out, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Errorf("Size %d. Expected error code \"%v\", got \"%v\"", size, nil, err)
+		}
+		if bytes.Compare(out, in[:1000]) != 0 {
+			t.Errorf("Size %d. Expected stream read=%q, got %q", size, in[:1000], out)
+		}
+	}
+}
+
+func TestShortBuffered(t *testing.T) {
+	c := chunkio.NewReader(bytes.NewReader([]byte("abc;def")))
+	if c.Buffered() != 0 {
+		t.Errorf("Buffered. Expected %d, got %d", 0, c.Buffered())
+	}
+	c.SetKey([]byte(";"))
+	c.Read(make([]byte, 2))
+	if c.Buffered() != 5 {
+		t.Errorf("Buffered. Expected %d, got %d", 5, c.Buffered())
+	}
+}
+
 func TestShortSetKey(t *testing.T) {
 	c := chunkio.NewReader(bytes.NewReader([]byte("")))
 	c.SetKey([]byte("123"))
@@ -54,6 +92,93 @@ func TestShortSetKey(t *testing.T) {
 	}
 }
 
+// Test that a new key already present in the buffer is found without reading
+// from the underlying reader, which here blocks once the buffer is filled.
+func TestShortSetKeyBuffered(t *testing.T) {
+	pr, pw := io.Pipe()
+	go pw.Write([]byte("abc;defgh|ijklmno"))
+	c := chunkio.NewReaderSize(pr, 16)
+	c.SetKey([]byte(";"))
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan []result, 1)
+	go func() {
+		var res []result
+		read := func() {
+			out, err := c.ReadChunk()
+			res = append(res, result{string(out), err})
+		}
+		read()
+		c.Reset()
+		c.SetKey([]byte("|"))
+		read()
+		// Change the key mid chunk after the old key was found
+		c.Reset()
+		c.SetKey([]byte("l"))
+		c.ReadByte()
+		c.SetKey([]byte("n"))
+		read()
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		for i, want := range []string{"abc", "defgh", "jklm"} {
+			if res[i].err != nil || res[i].out != want {
+				t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, res[i].out, res[i].err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("ReadChunk. Blocked reading a key already buffered")
+		pw.Close()
+	}
+}
+
+func TestShortSetKeyMidBuffer(t *testing.T) {
+	// After the first chunk the buffer holds the first 15 bytes of data
+	data := "abcdefghijklmnopqrstuvwxyz"
+	for _, pos := range []int{0, 1, 7, 13, 14, 20} {
+		key := data[pos : pos+2]
+		c := chunkio.NewReaderSize(strings.NewReader("x#"+data), 16)
+		c.SetKey([]byte("#"))
+		c.ReadChunk()
+		c.Reset()
+		if c.Buffered() != 15 {
+			t.Fatalf("Buffered. Expected %d, got %d", 15, c.Buffered())
+		}
+		c.SetKey([]byte(key))
+		if n, found := c.ChunkLen(); pos+2 <= 15 && (n != pos || !found || c.Buffered() != 15) {
+			t.Errorf("Key at %d. Expected key found at %d in the buffer, got %d, %v", pos, pos, n, found)
+		}
+		if out, err := c.ReadChunk(); err != nil || string(out) != data[:pos] {
+			t.Errorf("Key at %d. Expected %q (err %v), got %q (err %v)", pos, data[:pos], nil, out, err)
+		}
+		if c.Offset() != int64(pos+4) {
+			t.Errorf("Key at %d. Expected offset %d, got %d", pos, pos+4, c.Offset())
+		}
+		c.Reset()
+		if out, err := c.ReadChunk(); err != chunkio.ErrKeyNotFound || string(out) != data[pos+2:] {
+			t.Errorf("Key at %d. Expected %q (err %v), got %q (err %v)", pos, data[pos+2:], chunkio.ErrKeyNotFound, out, err)
+		}
+	}
+}
+
+func TestShortBufSize(t *testing.T) {
+	c := chunkio.NewReaderSize(bytes.NewReader([]byte("")), 100)
+	if c.BufSize() != 100 {
+		t.Errorf("BufSize. Expected %d, got %d", 100, c.BufSize())
+	}
+	c.SetKey([]byte("123"))
+	if c.BufSize() != 103 {
+		t.Errorf("BufSize. Expected %d, got %d", 103, c.BufSize())
+	}
+	c.SetKey(nil)
+	if c.BufSize() != 100 {
+		t.Errorf("BufSize. Expected %d, got %d", 100, c.BufSize())
+	}
+}
+
 func TestShortRead(t *testing.T) {
 	cases := []struct {
 		desc string
@@ -138,80 +263,2530 @@ func TestShortRead(t *testing.T) {
 	}
 }
 
-// Test each input length from zero up to a large number.
-func TestLongReadSizes(t *testing.T) {
-	for i := 0; i < 20000; i++ {
-		rd := chunkio.NewReader(bytes.NewReader(append(bytes.Repeat([]byte("X"), i), []byte(";;;")...)))
-		rd.SetKey([]byte(";;;"))
-		out, err := ioutil.ReadAll(rd)
-		if len(out) != i {
-			t.Errorf("Failed.  Read byte sequence size %d instead of %d", len(out), i)
+func TestShortReadLargeBuffer(t *testing.T) {
+	in := strings.Repeat("a", 3000) + ";" + strings.Repeat("b", 10000) + ";"
+	c := chunkio.NewReader(strings.NewReader(in))
+	c.SetKey([]byte(";"))
+	p := make([]byte, 1<<16)
+	// All the data scanned ahead of the key is delivered at once
+	for _, want := range []int{3000, 0, 4096, 4096, 1808, 0} {
+		n, err := c.Read(p)
+		if n != want || (n == 0) != (err == io.EOF) {
+			t.Errorf("Read. Expected %d bytes, got %d (err %v)", want, n, err)
 		}
-		if err != nil {
-			t.Errorf("Failed.  Attempted to read byte sequence size %q and got error %v", i, err)
+		if err == io.EOF {
+			c.Reset()
 		}
 	}
 }
 
-// Test a large number of cases randomizing the following:
-// * key (length and contents)
-// * input data before key (length and contents)
-// * additional "garbage" data after key (length and contents)
-func TestLongReadRand(t *testing.T) {
-	const (
-		numcycles = 8000
-		maxinput  = 4096 * 10
-		maxread   = maxinput / 10
-		maxkey    = maxinput / 12
-	)
+func TestShortValidKey(t *testing.T) {
+	for _, want := range []struct {
+		key []byte
+		err error
+	}{{nil, chunkio.ErrInvalidKey}, {[]byte{}, chunkio.ErrInvalidKey}, {[]byte(";"), nil}, {[]byte("\n---\n"), nil}} {
+		if err := chunkio.ValidKey(want.key); err != want.err {
+			t.Errorf("ValidKey(%q). Expected error code \"%v\", got \"%v\"", want.key, want.err, err)
+		}
+	}
+}
 
-	var (
-		key     []byte // Key sequence to use
-		input   []byte // Source sequence
-		output  []byte // Destination sequence
-		garbage []byte // Garbage sequence at end
-		readbuf []byte // Buffer to store each Read call in
-		num     int    // Number of bytes from Read
-		err     error  // Error return code from Read
-		cio     *chunkio.Reader
-	)
+func TestShortOptions(t *testing.T) {
+	in := "abc;" + strings.Repeat("x", 40) + ";d"
+	for _, opts := range [][]chunkio.Option{
+		{chunkio.WithKey([]byte(";")), chunkio.WithBufferSize(16), chunkio.WithMaxChunkSize(20)},
+		{chunkio.WithMaxChunkSize(20), chunkio.WithBufferSize(16), chunkio.WithKey([]byte(";"))},
+	} {
+		c := chunkio.NewReader(strings.NewReader(in), opts...)
+		for _, want := range []struct {
+			out string
+			err error
+		}{{"abc", nil}, {strings.Repeat("x", 20), chunkio.ErrChunkTooLarge}} {
+			out, err := c.ReadChunk()
+			if err != want.err || string(out) != want.out {
+				t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+			}
+			if c.Buffered() > 17 {
+				t.Errorf("Buffered. Expected at most %d bytes, got %d", 17, c.Buffered())
+			}
+			c.Reset()
+		}
+	}
+	c := chunkio.NewReader(strings.NewReader(in), chunkio.WithKey([]byte{}))
+	if _, err := c.ReadChunk(); err != chunkio.ErrInvalidKey {
+		t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
 
-	for i := 0; i < numcycles; i++ {
-		output = nil
-		key = make([]byte, rand.Intn(maxkey-1)+1)
-		rand.Read(key)
+func TestShortSetKeys(t *testing.T) {
+	c := chunkio.NewReader(bytes.NewReader([]byte("a: 1\n---\nb: 2\n...\nc: 3")))
+	if err := c.SetKeys([]byte("\n---\n"), nil); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetKeys. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+	if err := c.SetKeys([]byte("\n---\n"), []byte("\n...\n")); err != nil {
+		t.Errorf("SetKeys. Expected error code \"%v\", got \"%v\"", nil, err)
+	}
+	for _, want := range []struct{ chunk, key string }{{"a: 1", "\n---\n"}, {"b: 2", "\n...\n"}} {
+		out, err := c.ReadChunk()
+		if err != nil || string(out) != want.chunk {
+			t.Errorf("SetKeys. Expected chunk %q, got %q (err %v)", want.chunk, out, err)
+		}
+		if !c.Complete() {
+			t.Errorf("Complete. Expected %v, got %v", true, c.Complete())
+		}
+		if string(c.MatchedKey()) != want.key {
+			t.Errorf("MatchedKey. Expected %q, got %q", want.key, c.MatchedKey())
+		}
+		c.Reset()
+	}
+	out, err := c.ReadChunk()
+	if err != chunkio.ErrKeyNotFound || string(out) != "c: 3" {
+		t.Errorf("SetKeys. Expected chunk %q, got %q (err %v)", "c: 3", out, err)
+	}
+	if c.MatchedKey() != nil {
+		t.Errorf("MatchedKey. Expected %v, got %q", nil, c.MatchedKey())
+	}
+	if c.Complete() {
+		t.Errorf("Complete. Expected %v, got %v", false, c.Complete())
+	}
 
-		input = make([]byte, rand.Intn(maxinput-1)+1)
-		rand.Read(input)
+	// The empty read after the last key does not end another chunk
+	c = chunkio.NewReader(strings.NewReader("a: 1\n---\n"))
+	c.SetKeys([]byte("\n---\n"), []byte("\n...\n"))
+	c.SetChunkHash(crc32.NewIEEE())
+	c.ReadChunk()
+	c.Reset()
+	if out, err := c.ReadChunk(); err != chunkio.ErrKeyNotFound || len(out) != 0 {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "", chunkio.ErrKeyNotFound, out, err)
+	}
+	if !c.Complete() {
+		t.Errorf("Complete. Expected %v, got %v", true, c.Complete())
+	}
+	if got, want := binary.BigEndian.Uint32(c.ChunkSum()), crc32.ChecksumIEEE([]byte("a: 1")); got != want {
+		t.Errorf("ChunkSum. Expected %08x, got %08x", want, got)
+	}
+}
 
-		// Make sure key doesn't exist in input stream
-		for {
-			p := bytes.Index(input, key)
-			if p == -1 {
-				break
+func TestShortSetKeyStrings(t *testing.T) {
+	c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader("a,b;c,d")), 16)
+	c.SetKeyStrings(",", ";")
+	for _, want := range []struct {
+		chunk string
+		index int
+	}{{"a", 0}, {"b", 1}, {"c", 0}} {
+		out, err := c.ReadChunk()
+		if err != nil || string(out) != want.chunk {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.chunk, nil, out, err)
+		}
+		if c.MatchedIndex() != want.index {
+			t.Errorf("MatchedIndex. Expected %d, got %d", want.index, c.MatchedIndex())
+		}
+		c.Reset()
+		if c.MatchedIndex() != -1 {
+			t.Errorf("MatchedIndex. Expected %d, got %d", -1, c.MatchedIndex())
+		}
+	}
+	c.ReadChunk()
+	if c.MatchedIndex() != -1 {
+		t.Errorf("MatchedIndex. Expected %d, got %d", -1, c.MatchedIndex())
+	}
+	if err := c.SetKeyStrings(); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetKeyStrings. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
+
+func TestShortLongKey(t *testing.T) {
+	for _, n := range []int{15, 16, 17, 40, 5000} {
+		key := []byte(strings.Repeat("-", n-1) + "|")
+		chunks := []string{"", "a", strings.Repeat("-", 2*n), strings.Repeat("x", 3*n+7)}
+		var in []byte
+		for _, chunk := range chunks {
+			in = append(append(in, chunk...), key...)
+		}
+		for _, rd := range []io.Reader{bytes.NewReader(in), iotest.OneByteReader(bytes.NewReader(in)), iotest.HalfReader(bytes.NewReader(in))} {
+			c := chunkio.NewReaderSize(rd, 16)
+			c.SetKey(key)
+			for _, want := range chunks {
+				if out, err := c.ReadChunk(); err != nil || string(out) != want {
+					t.Errorf("Key length %d. Expected %q (err %v), got %q (err %v)", n, want, nil, out, err)
+				}
+				c.Reset()
+			}
+			if _, err := c.ReadChunk(); err != chunkio.ErrKeyNotFound {
+				t.Errorf("Key length %d. Expected error code \"%v\", got \"%v\"", n, chunkio.ErrKeyNotFound, err)
 			}
-			input[p] = input[p] + 1
 		}
+	}
+}
 
-		garbage = make([]byte, rand.Intn(maxinput-1)+1)
-		rand.Read(garbage)
+func TestShortSelfOverlappingKey(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, key := range []string{"aa", "aba", "aaa", "abab", strings.Repeat("a", 20)} {
+		for i := 0; i < 50; i++ {
+			// Mostly a's half of the time, so that long runs of a occur
+			alpha := []string{"ab", "aaaaaaaaaaaaaaab"}[i%2]
+			b := make([]byte, 16+rnd.Intn(200))
+			for j := range b {
+				b[j] = alpha[rnd.Intn(len(alpha))]
+			}
+			in := string(b)
+			want := strings.Split(in, key)
+			for _, rd := range []io.Reader{strings.NewReader(in), iotest.OneByteReader(strings.NewReader(in)), iotest.HalfReader(strings.NewReader(in))} {
+				c := chunkio.NewReaderSize(rd, 16)
+				c.SetKey([]byte(key))
+				var out []string
+				for chunk, err := range c.Chunks() {
+					if err != nil && err != chunkio.ErrKeyNotFound {
+						t.Fatalf("Chunks. Expected error code \"%v\", got \"%v\"", nil, err)
+					}
+					out = append(out, string(chunk))
+				}
+				if want[len(want)-1] == "" {
+					// Chunks does not yield the empty chunk after a final key
+					out = append(out, "")
+				}
+				if fmt.Sprintf("%q", out) != fmt.Sprintf("%q", want) {
+					t.Fatalf("Key %q in %q. Expected %q, got %q", key, in, want, out)
+				}
+			}
+		}
+	}
+}
 
-		cio = chunkio.NewReader(bytes.NewReader(append(append(input, key...), garbage...)))
-		cio.SetKey(key)
+func TestShortSetKeyAnyByte(t *testing.T) {
+	in := "a,b\tc;;d" + strings.Repeat("x", 40) + ",e"
+	for _, set := range []string{",\t;", ",\t;\xff"} {
+		c := chunkio.NewReaderSize(iotest.HalfReader(strings.NewReader(in)), 16)
+		if err := c.SetKeyAnyByte([]byte(set)); err != nil {
+			t.Fatalf("SetKeyAnyByte. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+		for _, want := range []struct {
+			out, key string
+			index    int
+			err      error
+		}{{"a", ",", 0, nil}, {"b", "\t", 1, nil}, {"c", ";", 2, nil}, {"", ";", 2, nil}, {"d" + strings.Repeat("x", 40), ",", 0, nil}, {"e", "", -1, chunkio.ErrKeyNotFound}} {
+			out, err := c.ReadChunk()
+			if err != want.err || string(out) != want.out {
+				t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+			}
+			if key := c.MatchedKey(); string(key) != want.key || c.MatchedIndex() != want.index {
+				t.Errorf("MatchedKey. Expected %q at %d, got %q at %d", want.key, want.index, key, c.MatchedIndex())
+			}
+			c.Reset()
+		}
+	}
+	c := chunkio.NewReader(strings.NewReader("a"))
+	if err := c.SetKeyAnyByte(nil); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetKeyAnyByte. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
+
+func TestShortSingleByteKey(t *testing.T) {
+	in := []byte(";a;;bc;" + strings.Repeat("d", 50) + ";e;" + strings.Repeat(";", 20) + "f")
+	read := func(c *chunkio.Reader) string {
+		var out []string
+		for chunk, err := range c.Chunks() {
+			out = append(out, fmt.Sprintf("%q %v %d", chunk, err, c.Offset()))
+		}
+		return strings.Join(out, "|")
+	}
+	for _, min := range []int{0, 1, 2} {
+		for _, rd := range []func() io.Reader{
+			func() io.Reader { return bytes.NewReader(in) },
+			func() io.Reader { return iotest.OneByteReader(bytes.NewReader(in)) },
+		} {
+			// Listing the key twice avoids the single byte scan
+			c1 := chunkio.NewReaderSize(rd(), 16)
+			c1.SetKey([]byte(";"))
+			c1.SetMinChunkSize(min)
+			c2 := chunkio.NewReaderSize(rd(), 16)
+			c2.SetKeys([]byte(";"), []byte(";"))
+			c2.SetMinChunkSize(min)
+			if out1, out2 := read(c1), read(c2); out1 != out2 {
+				t.Errorf("Minimum size %d. Expected %s, got %s", min, out2, out1)
+			}
+		}
+	}
+}
+
+// Test that a longer key wins over a shorter key listed later at the same
+// position, wherever the match lands relative to the buffer boundary.
+func TestShortSetKeysOverlap(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		in := append(bytes.Repeat([]byte("X"), i), []byte("abcdYY")...)
+		c := chunkio.NewReaderSize(bytes.NewReader(in), 16)
+		c.SetKeys([]byte("abcd"), []byte("ab"))
+		out, err := c.ReadChunk()
+		if err != nil || len(out) != i {
+			t.Errorf("Prefix %d. Expected chunk length %d, got %d (err %v)", i, i, len(out), err)
+		}
+		c.Reset()
+		out, _ = c.ReadChunk()
+		if string(out) != "YY" {
+			t.Errorf("Prefix %d. Expected chunk %q, got %q", i, "YY", out)
+		}
+	}
+}
+
+func TestShortSetKeepKey(t *testing.T) {
+	c := chunkio.NewReader(bytes.NewReader([]byte("\r\nabc\r\ndef")))
+	c.SetKey([]byte("\r\n"))
+	c.SetKeepKey(true)
+	for _, want := range []string{"\r\n", "abc\r\n"} {
+		out, err := c.ReadChunk()
+		if err != nil || string(out) != want {
+			t.Errorf("SetKeepKey. Expected chunk %q, got %q (err %v)", want, out, err)
+		}
+		c.Reset()
+	}
+	c.SetKeepKey(false)
+	out, err := c.ReadChunk()
+	if err != chunkio.ErrKeyNotFound || string(out) != "def" {
+		t.Errorf("SetKeepKey. Expected chunk %q, got %q (err %v)", "def", out, err)
+	}
+}
+
+func TestShortKeyOffset(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader("ab;;"+strings.Repeat("x", 40)+"<=>c;;d"), 16)
+	c.SetKeys([]byte(";;"), []byte("<=>"))
+	if off, ok := c.KeyOffset(); ok || off != -1 {
+		t.Errorf("KeyOffset. Expected %d, %v, got %d, %v", -1, false, off, ok)
+	}
+	for _, want := range []struct {
+		off  int64
+		ok   bool
+		keep bool
+	}{{2, true, false}, {44, true, true}, {48, true, false}, {-1, false, false}} {
+		c.SetKeepKey(want.keep)
+		c.ReadChunk()
+		if off, ok := c.KeyOffset(); ok != want.ok || off != want.off {
+			t.Errorf("KeyOffset. Expected %d, %v, got %d, %v", want.off, want.ok, off, ok)
+		}
+		c.Reset()
+	}
+}
+
+func TestShortKeepKeySuffix(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader(strings.Repeat("y", 30)+"\r\nab\nc;;;x\n"), 16)
+	c.SetKeys([]byte("\r\n"), []byte("\n"), []byte(";;"))
+	c.SetKeepKey(true)
+	p := make([]byte, 4)
+	for _, want := range []struct{ data, key string }{{strings.Repeat("y", 30), "\r\n"}, {"ab", "\n"}, {"c", ";;"}, {";x", "\n"}} {
+		var out []byte
 		for {
-			readbuf = make([]byte, rand.Intn(maxread-1)+1)
-			num, err = cio.Read(readbuf)
-			if err == nil {
-				output = append(output, readbuf[:num]...)
-			} else {
+			n, err := c.Read(p)
+			out = append(out, p[:n]...)
+			if err == io.EOF {
 				break
 			}
+			if err != nil {
+				t.Fatalf("Read. Expected error code \"%v\", got \"%v\"", nil, err)
+			}
 		}
-		if bytes.Compare(input, output) != 0 {
-			t.Errorf("Cycle %d failed. Input and output differ!", i)
+		key := c.MatchedKey()
+		if string(key) != want.key || !bytes.HasSuffix(out, key) || string(out[:len(out)-len(key)]) != want.data {
+			t.Errorf("SetKeepKey. Expected %q with key %q, got %q with key %q", want.data+want.key, want.key, out, key)
 		}
-		if len(output) != len(input) {
-			t.Errorf("Cycle %d failed. Read size should be %d but was %d", i, len(input), len(output))
+		c.Reset()
+	}
+}
+
+func TestShortPeek(t *testing.T) {
+	c := chunkio.NewReaderSize(bytes.NewReader(append(bytes.Repeat([]byte("x"), 40), []byte("abc;def")...)), 16)
+	c.SetKey([]byte(";"))
+	cases := []struct {
+		n   int
+		out string
+		err error
+	}{
+		{4, "xxxx", nil},
+		{100, "xxxxxxxxxxxxxxxx", chunkio.ErrBufferFull},
+		{-1, "", chunkio.ErrNegativeCount},
+	}
+	for _, e := range cases {
+		out, err := c.Peek(e.n)
+		if err != e.err || string(out) != e.out {
+			t.Errorf("Peek(%d). Expected %q (err %v), got %q (err %v)", e.n, e.out, e.err, out, err)
+		}
+	}
+	if _, err := io.ReadFull(c, make([]byte, 40)); err != nil {
+		t.Errorf("ReadFull. Expected error code \"%v\", got \"%v\"", nil, err)
+	}
+	out, err := c.Peek(10)
+	if err != io.EOF || string(out) != "abc" {
+		t.Errorf("Peek(10). Expected %q (err %v), got %q (err %v)", "abc", io.EOF, out, err)
+	}
+	c.ReadChunk()
+	c.Reset()
+	out, err = c.Peek(10)
+	if err != chunkio.ErrKeyNotFound || string(out) != "def" {
+		t.Errorf("Peek(10). Expected %q (err %v), got %q (err %v)", "def", chunkio.ErrKeyNotFound, out, err)
+	}
+}
+
+func TestShortChunkLen(t *testing.T) {
+	c := chunkio.NewReaderSize(bytes.NewReader([]byte("abc;d;"+strings.Repeat("x", 40))), 16)
+	c.SetKey([]byte(";"))
+	cases := []struct {
+		read  int
+		n     int
+		found bool
+	}{
+		{0, 3, true},
+		{2, 1, true},
+		{2, 0, true},
+		{-1, 1, true},
+		{2, 0, true},
+		{-1, 16, false},
+		{10, 16, false},
+		{40, 0, false},
+	}
+	p := make([]byte, 64)
+	for i, x := range cases {
+		if x.read < 0 {
+			c.Reset()
+		} else {
+			io.ReadFull(c, p[:x.read])
+		}
+		if n, found := c.ChunkLen(); n != x.n || found != x.found {
+			t.Errorf("Case %d. Expected %d, %v, got %d, %v", i, x.n, x.found, n, found)
+		}
+	}
+
+	c = chunkio.NewReader(bytes.NewReader([]byte{0, 0, 0, 5, 'a', 'b'}))
+	c.SetLengthPrefixed(binary.BigEndian, 4)
+	if n, found := c.ChunkLen(); n != 5 || !found {
+		t.Errorf("Length prefixed. Expected %d, %v, got %d, %v", 5, true, n, found)
+	}
+}
+
+func TestShortPeekChunk(t *testing.T) {
+	c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader("abc;"+strings.Repeat("x", 30)+";yz")), 16)
+	c.SetKey([]byte(";"))
+	cases := []struct {
+		out   string
+		found bool
+		err   error
+	}{
+		{"abc", true, nil},
+		{strings.Repeat("x", 16), false, nil},
+		{"yz", false, nil},
+		{"", false, chunkio.ErrKeyNotFound},
+	}
+	for i, x := range cases {
+		out, found, err := c.PeekChunk()
+		if string(out) != x.out || found != x.found || err != x.err {
+			t.Errorf("Case %d. Expected %q, %v (err %v), got %q, %v (err %v)", i, x.out, x.found, x.err, out, found, err)
+		}
+		if chunk, _ := c.ReadChunk(); !bytes.HasPrefix(chunk, []byte(x.out)) {
+			t.Errorf("Case %d. Expected chunk starting with %q, got %q", i, x.out, chunk)
+		}
+		c.Reset()
+	}
+}
+
+func TestShortSetMaxPeek(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	for _, x := range []struct {
+		peek, max int
+		out       string
+		found     bool
+	}{
+		{0, 0, long[:16], false},
+		{50, 0, long[:50], false},
+		{100, 0, long, true},
+		{1000, 0, long, true},
+		{1000, 60, long[:60], false},
+	} {
+		c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader(long+";abc;")), 16)
+		c.SetKey([]byte(";"))
+		c.SetMaxPeek(x.peek)
+		c.SetMaxChunkSize(x.max)
+		out, found, err := c.PeekChunk()
+		if string(out) != x.out || found != x.found || err != nil {
+			t.Errorf("Peek %d, max %d. Expected %q, %v (err %v), got %q, %v (err %v)", x.peek, x.max, x.out, x.found, nil, out, found, err)
+		}
+		if x.max > 0 {
+			continue
+		}
+		for _, want := range []string{long, "abc"} {
+			if out, err := c.ReadChunk(); err != nil || string(out) != want {
+				t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+			}
+			c.Reset()
+		}
+	}
+}
+
+func TestShortOffset(t *testing.T) {
+	in := "ab;;cde;;f"
+	c := chunkio.NewReader(strings.NewReader(in))
+	c.SetKey([]byte(";;"))
+	for i, want := range []int64{4, 9} {
+		c.ReadChunk()
+		if c.Offset() != want {
+			t.Errorf("Offset. Expected %d, got %d", want, c.Offset())
+		}
+		if c.ChunkCount() != i+1 {
+			t.Errorf("ChunkCount. Expected %d, got %d", i+1, c.ChunkCount())
+		}
+		c.Reset()
+	}
+	c.ReadChunk()
+	if c.ChunkCount() != 2 {
+		t.Errorf("ChunkCount. Expected %d, got %d", 2, c.ChunkCount())
+	}
+	c.Reset()
+	c.SetKey(nil)
+	if c.Offset() != int64(len(in)) {
+		t.Errorf("Offset. Expected %d, got %d", len(in), c.Offset())
+	}
+}
+
+func TestShortSkipChunk(t *testing.T) {
+	long := strings.Repeat("0123456789", 1000)
+	c := chunkio.NewReader(strings.NewReader(long + ";odd;" + long + ";even"))
+	c.SetKey([]byte(";"))
+	var out []string
+	for i := 0; ; i++ {
+		var err error
+		if i%2 == 0 {
+			err = c.SkipChunk()
+		} else {
+			var b []byte
+			b, err = c.ReadChunk()
+			out = append(out, string(b))
+		}
+		if err != nil {
+			if err != chunkio.ErrKeyNotFound || i != 3 {
+				t.Errorf("SkipChunk. Unexpected error %v at chunk %d", err, i)
+			}
+			break
+		}
+		c.Reset()
+	}
+	if len(out) != 2 || out[0] != "odd" || out[1] != "even" {
+		t.Errorf("SkipChunk. Expected chunks %q, got %q", []string{"odd", "even"}, out)
+	}
+}
+
+func TestShortSetMaxChunkSize(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abcd;abcdef;ab"))
+	c.SetKey([]byte(";"))
+	c.SetMaxChunkSize(4)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abcd", nil}, {"abcd", chunkio.ErrChunkTooLarge}, {"ab", chunkio.ErrKeyNotFound}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		if err == chunkio.ErrChunkTooLarge {
+			c.SetMaxChunkSize(0)
+			c.Reset()
+			c.ReadChunk()
+			c.SetMaxChunkSize(4)
+		}
+		c.Reset()
+	}
+}
+
+func TestShortSetCaseInsensitive(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("oneENDtwoendthreeEnDfourÉND"))
+	c.SetKey([]byte("end"))
+	c.SetCaseInsensitive(true)
+	for _, want := range []string{"one", "two", "three"} {
+		out, err := c.ReadChunk()
+		if err != nil || string(out) != want {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+		}
+		c.Reset()
+	}
+	out, err := c.ReadChunk()
+	if err != chunkio.ErrKeyNotFound || string(out) != "fourÉND" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "fourÉND", chunkio.ErrKeyNotFound, out, err)
+	}
+}
+
+func TestShortSetKeyPattern(t *testing.T) {
+	in := []byte("one\xaa\xbb\x01\xcc\xddtwo\xaa\xbb\xcc\xdd\xaa\xbb\x02\xcc\xddthree\xaa\xbb")
+	c := chunkio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(in)), 16)
+	if err := c.SetKeyPattern([]byte{0xaa, 0xbb, '?', 0xcc, 0xdd}, '?'); err != nil {
+		t.Fatalf("SetKeyPattern. Expected error code \"%v\", got \"%v\"", nil, err)
+	}
+	for _, want := range []string{"one", "two\xaa\xbb\xcc\xdd"} {
+		out, err := c.ReadChunk()
+		if err != nil || string(out) != want {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+		}
+		c.Reset()
+	}
+	if key := c.MatchedKey(); string(key) != "\xaa\xbb\x02\xcc\xdd" {
+		t.Errorf("MatchedKey. Expected %q, got %q", "\xaa\xbb\x02\xcc\xdd", key)
+	}
+	out, err := c.ReadChunk()
+	if err != chunkio.ErrKeyNotFound || string(out) != "three\xaa\xbb" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "three\xaa\xbb", chunkio.ErrKeyNotFound, out, err)
+	}
+	if err := c.SetKeyPattern([]byte("??"), '?'); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetKeyPattern. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
+
+func TestShortSetKeySelector(t *testing.T) {
+	// Records of type A end with a newline and records of type B with "END"
+	in := "Aone\nBtwo\nENDA\nBEND" + strings.Repeat("x", 30) + "END"
+	for _, rd := range []io.Reader{strings.NewReader(in), iotest.OneByteReader(strings.NewReader(in))} {
+		c := chunkio.NewReaderSize(rd, 16)
+		err := c.SetKeySelector(1, func(prefix []byte) []byte {
+			if prefix[0] == 'B' {
+				return []byte("END")
+			}
+			return []byte("\n")
+		})
+		if err != nil {
+			t.Fatalf("SetKeySelector. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+		chunks, err := c.ReadAllChunks()
+		want := []string{"Aone", "Btwo\n", "A", "B", strings.Repeat("x", 30) + "END"}
+		if err != chunkio.ErrKeyNotFound || fmt.Sprintf("%q", chunks) != fmt.Sprintf("%q", want) {
+			t.Errorf("ReadAllChunks. Expected %q (err %v), got %q (err %v)", want, chunkio.ErrKeyNotFound, chunks, err)
+		}
+	}
+	c := chunkio.NewReader(strings.NewReader("abc"))
+	if err := c.SetKeySelector(5000, func([]byte) []byte { return nil }); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetKeySelector. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+	c.SetKeySelector(2, func([]byte) []byte { return nil })
+	if _, err := c.ReadChunk(); err != chunkio.ErrInvalidKey {
+		t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
+
+func TestShortSetKeyRune(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc§def"))
+	if err := c.SetKeyRune(utf8.RuneError); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetKeyRune. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+	if err := c.SetKeyRune('§'); err != nil || string(c.GetKey()) != "§" {
+		t.Errorf("SetKeyRune. Expected key %q (err %v), got %q (err %v)", "§", nil, c.GetKey(), err)
+	}
+	if out, err := c.ReadChunk(); err != nil || string(out) != "abc" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "abc", nil, out, err)
+	}
+}
+
+func TestShortSetBracket(t *testing.T) {
+	in := "preamble <<<a>>> x <<<b>>c>>><<<>>>\n" + strings.Repeat("<", 40) + "<d>>> <<<e"
+	for _, rd := range []io.Reader{strings.NewReader(in), iotest.OneByteReader(strings.NewReader(in))} {
+		c := chunkio.NewReaderSize(rd, 16)
+		if err := c.SetBracket([]byte("<<<"), []byte(">>>")); err != nil {
+			t.Fatalf("SetBracket. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+		chunks, err := c.ReadAllChunks()
+		want := []string{"a", "b>>c", "", strings.Repeat("<", 38) + "d", "e"}
+		if err != chunkio.ErrKeyNotFound || fmt.Sprintf("%q", chunks) != fmt.Sprintf("%q", want) {
+			t.Errorf("ReadAllChunks. Expected %q (err %v), got %q (err %v)", want, chunkio.ErrKeyNotFound, chunks, err)
+		}
+	}
+
+	c := chunkio.NewReader(strings.NewReader("<ab> <cd> x <ef>"))
+	c.SetBracket([]byte("<"), []byte(">"))
+	c.ReadByte()
+	c.Reset()
+	if out, err := c.ReadChunk(); err != nil || string(out) != "cd" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "cd", nil, out, err)
+	}
+	c.UnreadChunk([]byte("xy"))
+	for _, want := range []string{"xy", "ef"} {
+		if out, err := c.ReadChunk(); err != nil || string(out) != want {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+		}
+		c.Reset()
+	}
+	if out, err := c.ReadChunk(); err != chunkio.ErrKeyNotFound || len(out) != 0 {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "", chunkio.ErrKeyNotFound, out, err)
+	}
+	if err := c.SetBracket(nil, []byte(">")); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetBracket. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
+
+func TestShortSetLineMode(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader("one\r\ntwo\n\r\nthree\rfour\n\nfive"), 16)
+	c.SetLineMode()
+	var out []string
+	for line, err := range c.Chunks() {
+		if err != nil && err != chunkio.ErrKeyNotFound {
+			t.Errorf("Chunks. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+		out = append(out, string(line))
+	}
+	want := []string{"one", "two", "", "three\rfour", "", "five"}
+	if fmt.Sprintf("%q", out) != fmt.Sprintf("%q", want) {
+		t.Errorf("Chunks. Expected %q, got %q", want, out)
+	}
+}
+
+func TestShortSetKeyRegexp(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("one\n###\ntwo\n##\nstill two\n#####\nthree"))
+	for _, expr := range []string{`#*`, `;|\b`, `^`, `(?m:$)|x`, `(a|)(b?)`} {
+		if err := c.SetKeyRegexp(regexp.MustCompile(expr)); err != chunkio.ErrInvalidKey {
+			t.Errorf("SetKeyRegexp(%q). Expected error code \"%v\", got \"%v\"", expr, chunkio.ErrInvalidKey, err)
+		}
+	}
+	if err := c.SetKeyRegexp(regexp.MustCompile(`\b;+\b`)); err != nil {
+		t.Errorf("SetKeyRegexp(%q). Expected error code \"%v\", got \"%v\"", `\b;+\b`, nil, err)
+	}
+	c.SetKeyRegexp(regexp.MustCompile(`\n#{3,}\n`))
+	for _, want := range []struct{ out, key string }{{"one", "\n###\n"}, {"two\n##\nstill two", "\n#####\n"}} {
+		out, err := c.ReadChunk()
+		if err != nil || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, nil, out, err)
+		}
+		if string(c.MatchedKey()) != want.key {
+			t.Errorf("MatchedKey. Expected %q, got %q", want.key, c.MatchedKey())
+		}
+		c.Reset()
+	}
+	out, err := c.ReadChunk()
+	if err != chunkio.ErrKeyNotFound || string(out) != "three" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "three", chunkio.ErrKeyNotFound, out, err)
+	}
+
+	// A match that may be split across buffer fills
+	for i := 0; i < 100; i++ {
+		in := strings.Repeat("x", i) + "\n" + strings.Repeat("#", 14) + "\ny"
+		c := chunkio.NewReaderSize(strings.NewReader(in), 16)
+		c.SetKeyRegexp(regexp.MustCompile(`\n#{3,}\n`))
+		out, err := c.ReadChunk()
+		if err != nil || len(out) != i {
+			t.Errorf("Prefix %d. Expected chunk length %d, got %d (err %v)", i, i, len(out), err)
+		}
+		if len(c.MatchedKey()) != 16 {
+			t.Errorf("Prefix %d. Expected match length %d, got %d", i, 16, len(c.MatchedKey()))
+		}
+	}
+}
+
+func TestShortSetKeyFunc(t *testing.T) {
+	// The key is a NUL byte, a length byte and that many trailer bytes
+	fn := func(data []byte, atEOF bool) (int, int) {
+		i := bytes.IndexByte(data, 0)
+		if i < 0 {
+			return len(data), 0
+		}
+		if i+1 >= len(data) {
+			return i, 0
+		}
+		if n := 2 + int(data[i+1]); i+n <= len(data) {
+			return i, n
+		}
+		return i, 0
+	}
+	in := append(bytes.Repeat([]byte("x"), 50), "\x00\x03abcone\x00\x00two;three"...)
+	c := chunkio.NewReaderSize(bytes.NewReader(in), 16)
+	c.SetKey([]byte(";"))
+	c.SetKeyFunc(fn)
+	for _, want := range []struct{ out, key string }{{string(in[:50]), "\x00\x03abc"}, {"one", "\x00\x00"}} {
+		out, err := c.ReadChunk()
+		if err != nil || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, nil, out, err)
+		}
+		if string(c.MatchedKey()) != want.key {
+			t.Errorf("MatchedKey. Expected %q, got %q", want.key, c.MatchedKey())
+		}
+		c.Reset()
+	}
+	c.SetKeyFunc(nil)
+	if out, err := c.ReadChunk(); err != nil || string(out) != "two" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "two", nil, out, err)
+	}
+	c.Reset()
+	c.SetKeyFunc(func(data []byte, atEOF bool) (int, int) { return len(data), 1 })
+	if _, err := c.ReadChunk(); err != chunkio.ErrKeyFunc {
+		t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrKeyFunc, err)
+	}
+}
+
+type closer struct {
+	io.Reader
+	closed int
+}
+
+func (c *closer) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestShortClose(t *testing.T) {
+	rd := &closer{Reader: strings.NewReader("abc;def")}
+	c := chunkio.NewReader(rd)
+	c.SetKey([]byte(";"))
+	c.ReadByte()
+	if err := c.Close(); err != nil || rd.closed != 1 {
+		t.Errorf("Close. Expected error %v and 1 close, got %v and %d", nil, err, rd.closed)
+	}
+	if err := c.Close(); err != chunkio.ErrClosed || rd.closed != 1 {
+		t.Errorf("Close. Expected error %v and 1 close, got %v and %d", chunkio.ErrClosed, err, rd.closed)
+	}
+	c.Reset()
+	c.SetKey(nil)
+	if _, err := c.Read(make([]byte, 10)); err != chunkio.ErrClosed {
+		t.Errorf("Read. Expected error code \"%v\", got \"%v\"", chunkio.ErrClosed, err)
+	}
+	if err := chunkio.NewReader(strings.NewReader("")).Close(); err != nil {
+		t.Errorf("Close. Expected error code \"%v\", got \"%v\"", nil, err)
+	}
+}
+
+func TestShortStats(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;;def"))
+	c.SetKey([]byte(";;"))
+	c.ReadChunk()
+	want := chunkio.Stats{BytesRead: 5, ChunksRead: 1, KeyFound: true, BufferedBytes: 3}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats. Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestShortResetErr(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader("abc;"+strings.Repeat("x", 40)+";ghi;"), 16)
+	c.SetKey([]byte(";"))
+	var out []string
+	for {
+		b, err := c.ReadChunk()
+		if err != nil {
+			t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+		out = append(out, string(b))
+		if err := c.ResetErr(); err != nil {
+			if err != io.EOF {
+				t.Errorf("ResetErr. Expected error code \"%v\", got \"%v\"", io.EOF, err)
+			}
+			break
+		}
+	}
+	if len(out) != 3 || out[2] != "ghi" {
+		t.Errorf("ResetErr. Expected 3 chunks ending with %q, got %q", "ghi", out)
+	}
+	c.Close()
+	if err := c.ResetErr(); err != chunkio.ErrClosed {
+		t.Errorf("ResetErr. Expected error code \"%v\", got \"%v\"", chunkio.ErrClosed, err)
+	}
+}
+
+func TestShortSetSynchronized(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader(strings.Repeat("abcdefgh;", 1000)), 16)
+	c.SetKey([]byte(";"))
+	c.SetSynchronized(true)
+	done := make(chan int)
+	go func() {
+		n := 0
+		for range c.Chunks() {
+			n++
+		}
+		done <- n
+	}()
+	for i := 0; i < 100; i++ {
+		c.Stats()
+		c.Buffered()
+	}
+	if n := <-done; n != 1000 || c.Stats().ChunksRead != 1000 {
+		t.Errorf("Chunks. Expected %d chunks, got %d (ChunkCount %d)", 1000, n, c.Stats().ChunksRead)
+	}
+
+	// Stats does not wait for a stalled read of the underlying Reader
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	c = chunkio.NewReader(pr)
+	c.SetKey([]byte(";"))
+	c.SetSynchronized(true)
+	chunk := make(chan string, 1)
+	go func() {
+		out, _ := c.ReadChunk()
+		chunk <- string(out)
+	}()
+	stats := make(chan chunkio.Stats, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Buffered()
+		c.Offset()
+		stats <- c.Stats()
+	}()
+	select {
+	case s := <-stats:
+		if s.BytesRead != 0 || s.BufferedBytes != 0 {
+			t.Errorf("Stats. Expected %d bytes read and %d buffered, got %d and %d", 0, 0, s.BytesRead, s.BufferedBytes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Stats. Blocked while reading the underlying Reader")
+	}
+	pw.Write([]byte("abc;"))
+	pw.Close()
+	select {
+	case out := <-chunk:
+		if out != "abc" {
+			t.Errorf("ReadChunk. Expected %q, got %q", "abc", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("ReadChunk. Blocked after the data was written")
+	}
+}
+
+func TestShortResetReader(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;def;ghi"))
+	c.SetKey([]byte(";"))
+	c.ReadChunk()
+	c.Close()
+	c.ResetReader(strings.NewReader("jkl;mno"))
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"jkl", nil}, {"mno", chunkio.ErrKeyNotFound}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	if c.ChunkCount() != 1 || c.Offset() != 7 {
+		t.Errorf("ResetReader. Expected count %d and offset %d, got %d and %d", 1, 7, c.ChunkCount(), c.Offset())
+	}
+
+	// Data read from the previous reader mid chunk is not part of the next chunk
+	c = chunkio.NewReader(strings.NewReader("abc;"))
+	c.SetKey([]byte(";"))
+	c.SetRetainChunks(true)
+	c.SetChunkHash(crc32.NewIEEE())
+	c.Read(make([]byte, 2))
+	c.ResetReader(strings.NewReader("xyz;"))
+	ioutil.ReadAll(c)
+	if string(c.LastChunk()) != "xyz" {
+		t.Errorf("LastChunk. Expected %q, got %q", "xyz", c.LastChunk())
+	}
+	if got, want := binary.BigEndian.Uint32(c.ChunkSum()), crc32.ChecksumIEEE([]byte("xyz")); got != want {
+		t.Errorf("ChunkSum. Expected %08x, got %08x", want, got)
+	}
+}
+
+func TestShortNewMultiReader(t *testing.T) {
+	c := chunkio.NewMultiReader([]byte(";;"),
+		strings.NewReader("abc;"), strings.NewReader(";de"), strings.NewReader(";"), strings.NewReader(";f;"))
+	if out, err := c.ReadAllChunks(); err != chunkio.ErrKeyNotFound || fmt.Sprintf("%q", out) != `["abc" "de" "f;"]` {
+		t.Errorf("ReadAllChunks. Expected %q (err %v), got %q (err %v)", []string{"abc", "de", "f;"}, chunkio.ErrKeyNotFound, out, err)
+	}
+	c = chunkio.NewMultiReader([]byte(""), strings.NewReader("abc"))
+	if _, err := c.Read(make([]byte, 10)); err != chunkio.ErrInvalidKey {
+		t.Errorf("Read. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
+
+func TestShortUnderlying(t *testing.T) {
+	rd := strings.NewReader("abc")
+	if c := chunkio.NewReader(rd); c.Underlying() != rd {
+		t.Errorf("Underlying. Expected %v, got %v", rd, c.Underlying())
+	}
+}
+
+func TestShortPrefetch(t *testing.T) {
+	c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader("abc;"+strings.Repeat("x", 16))), 16)
+	c.SetKey([]byte(";"))
+	if err := c.Prefetch(); err != nil || c.Buffered() != 17 {
+		t.Errorf("Prefetch. Expected %d bytes (err %v), got %d (err %v)", 17, nil, c.Buffered(), err)
+	}
+	if out, err := c.ReadChunk(); err != nil || string(out) != "abc" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "abc", nil, out, err)
+	}
+	c.Reset()
+	if err := c.Prefetch(); err != io.EOF || c.Buffered() != 16 {
+		t.Errorf("Prefetch. Expected %d bytes (err %v), got %d (err %v)", 16, io.EOF, c.Buffered(), err)
+	}
+	c.Close()
+	if err := c.Prefetch(); err != chunkio.ErrClosed {
+		t.Errorf("Prefetch. Expected error code \"%v\", got \"%v\"", chunkio.ErrClosed, err)
+	}
+}
+
+func TestShortDrained(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;;de;;f;"))
+	c.SetKey([]byte(";;"))
+	if c.Drained() {
+		t.Errorf("Drained. Expected %v, got %v", false, true)
+	}
+	for _, want := range []bool{false, true} {
+		c.ReadChunk()
+		if c.Drained() != want {
+			t.Errorf("Drained. Expected %v, got %v", want, !want)
+		}
+		c.Reset()
+	}
+	if out, err := c.ReadChunk(); err != chunkio.ErrKeyNotFound || string(out) != "f;" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "f;", chunkio.ErrKeyNotFound, out, err)
+	}
+	if !c.Drained() {
+		t.Errorf("Drained. Expected %v, got %v", true, false)
+	}
+}
+
+func TestShortPassthrough(t *testing.T) {
+	in := "one;two;;three;four"
+	c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader(in)), 16)
+	c.SetKey([]byte(";"))
+	c.SetTransform(func(p []byte) {
+		if c.ChunkCount() == 3 {
+			copy(p, bytes.ToUpper(p))
+		}
+	})
+	out, err := ioutil.ReadAll(c.Passthrough())
+	if err != nil || string(out) != "one;two;;THREE;four" {
+		t.Errorf("ReadAll. Expected %q (err %v), got %q (err %v)", "one;two;;THREE;four", nil, out, err)
+	}
+	if c.ChunkCount() != 4 {
+		t.Errorf("ChunkCount. Expected %d, got %d", 4, c.ChunkCount())
+	}
+
+	c = chunkio.NewReader(strings.NewReader(in))
+	c.SetKey([]byte(";"))
+	p := make([]byte, 5)
+	c.Passthrough().Read(p)
+	if out, err := c.ReadChunk(); err != nil || string(out) != "two" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "two", nil, out, err)
+	}
+}
+
+func TestShortResidual(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;def;trailing garbage"))
+	c.SetKey([]byte(";"))
+	c.SkipChunk()
+	c.Reset()
+	c.SkipChunk()
+	out, err := ioutil.ReadAll(c.Residual())
+	if err != nil || string(out) != "trailing garbage" {
+		t.Errorf("Residual. Expected %q (err %v), got %q (err %v)", "trailing garbage", nil, out, err)
+	}
+	if !bytes.Equal(c.GetKey(), []byte(";")) {
+		t.Errorf("GetKey. Expected %q, got %q", ";", c.GetKey())
+	}
+}
+
+func TestShortReadContext(t *testing.T) {
+	pr, pw := io.Pipe()
+	c := chunkio.NewReader(pr)
+	c.SetKey([]byte(";"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReadContext(ctx, make([]byte, 10)); err != context.DeadlineExceeded {
+		t.Errorf("ReadContext. Expected error code \"%v\", got \"%v\"", context.DeadlineExceeded, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := pw.Write([]byte("abc;def"))
+		pw.Close()
+		done <- err
+	}()
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", nil}, {"def", chunkio.ErrKeyNotFound}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Write. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Write. Blocked writing the stream after ReadContext")
+		pr.Close()
+	}
+}
+
+func TestShortChunks(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("a;b;;c"))
+	c.SetKey([]byte(";"))
+	var out []string
+	var errs []error
+	for chunk, err := range c.Chunks() {
+		out = append(out, string(chunk))
+		errs = append(errs, err)
+	}
+	want := []string{"a", "b", "", "c"}
+	if strings.Join(out, "|") != strings.Join(want, "|") {
+		t.Errorf("Chunks. Expected %q, got %q", want, out)
+	}
+	if len(errs) != 4 || errs[2] != nil || errs[3] != chunkio.ErrKeyNotFound {
+		t.Errorf("Chunks. Expected errors %v, got %v", []error{nil, nil, nil, chunkio.ErrKeyNotFound}, errs)
+	}
+
+	// Stop early and continue with the next chunk
+	c = chunkio.NewReader(strings.NewReader("a;b;"))
+	c.SetKey([]byte(";"))
+	for range c.Chunks() {
+		break
+	}
+	if out, err := c.ReadChunk(); err != nil || string(out) != "b" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "b", nil, out, err)
+	}
+}
+
+func TestShortSetLengthPrefixed(t *testing.T) {
+	var in bytes.Buffer
+	for _, frame := range []string{"abc", "", strings.Repeat("x", 5000), "defgh", "ij"} {
+		binary.Write(&in, binary.BigEndian, uint32(len(frame)))
+		in.WriteString(frame)
+	}
+	in.WriteString("\x00\x00\x00\x05kl")
+	c := chunkio.NewReader(&in)
+	if err := c.SetLengthPrefixed(binary.BigEndian, 3); err != chunkio.ErrInvalidKey {
+		t.Errorf("SetLengthPrefixed. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+	c.SetLengthPrefixed(binary.BigEndian, 4)
+	c.SetMaxChunkSize(4096)
+	for _, want := range []struct {
+		out string
+		err error
+	}{
+		{"abc", nil},
+		{"", nil},
+		{strings.Repeat("x", 4096), chunkio.ErrChunkTooLarge},
+		{"defgh", nil},
+		{"ij", nil},
+		{"kl", chunkio.ErrKeyNotFound},
+		{"", chunkio.ErrKeyNotFound},
+	} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	if c.ChunkCount() != 4 {
+		t.Errorf("ChunkCount. Expected %d, got %d", 4, c.ChunkCount())
+	}
+
+	c = chunkio.NewReader(strings.NewReader("\x02ab\x00\x01c"))
+	c.SetLengthPrefixed(nil, 1)
+	c.SetSkipEmpty(true)
+	if out, err := c.ReadAllChunks(); err != nil || fmt.Sprintf("%q", out) != `["ab" "c"]` {
+		t.Errorf("ReadAllChunks. Expected %q (err %v), got %q (err %v)", []string{"ab", "c"}, nil, out, err)
+	}
+}
+
+func TestShortSetMaxTotal(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;defgh;ij"))
+	c.SetKey([]byte(";"))
+	c.SetMaxTotal(7)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", nil}, {"def", chunkio.ErrMaxTotalExceeded}, {"", chunkio.ErrMaxTotalExceeded}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	c.SetKey(nil)
+	if out, err := c.ReadChunk(); err != chunkio.ErrMaxTotalExceeded || len(out) != 0 {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "", chunkio.ErrMaxTotalExceeded, out, err)
+	}
+	if c.Offset() != 7 {
+		t.Errorf("Offset. Expected %d, got %d", 7, c.Offset())
+	}
+
+	c = chunkio.NewReader(strings.NewReader("abcdefgh"))
+	c.SetMaxTotal(5)
+	if out, err := ioutil.ReadAll(c); err != chunkio.ErrMaxTotalExceeded || string(out) != "abcde" {
+		t.Errorf("ReadAll. Expected %q (err %v), got %q (err %v)", "abcde", chunkio.ErrMaxTotalExceeded, out, err)
+	}
+	c = chunkio.NewReader(strings.NewReader("abcdefgh"))
+	c.SetMaxTotal(5)
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != chunkio.ErrMaxTotalExceeded || b.String() != "abcde" {
+		t.Errorf("WriteTo. Expected %q (err %v), got %q (err %v)", "abcde", chunkio.ErrMaxTotalExceeded, b.String(), err)
+	}
+}
+
+func TestShortSetChunkLimit(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abcdefgh;ij;klmnop;q"))
+	c.SetKey([]byte(";"))
+	c.SetChunkLimit(3)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", nil}, {"ij", nil}, {"klm", nil}, {"q", chunkio.ErrKeyNotFound}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+
+	c = chunkio.NewReader(strings.NewReader("abcdefgh;ijklm;"))
+	c.SetKey([]byte(";"))
+	c.SetChunkLimit(4)
+	p := make([]byte, 3)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", nil}, {"d", nil}, {"", io.EOF}} {
+		n, err := c.Read(p)
+		if err != want.err || string(p[:n]) != want.out {
+			t.Errorf("Read. Expected %q (err %v), got %q (err %v)", want.out, want.err, p[:n], err)
+		}
+	}
+	if c.Offset() != 9 {
+		t.Errorf("Offset. Expected %d, got %d", 9, c.Offset())
+	}
+	c.Reset()
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != nil || b.String() != "ijkl" {
+		t.Errorf("WriteTo. Expected %q (err %v), got %q (err %v)", "ijkl", nil, b.String(), err)
+	}
+	if c.Offset() != 15 {
+		t.Errorf("Offset. Expected %d, got %d", 15, c.Offset())
+	}
+}
+
+func TestShortResetFull(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader("abc;def;ghi"), 16)
+	c.SetKey([]byte(";"))
+	c.SetTransform(func(p []byte) { copy(p, bytes.ToUpper(p)) })
+	c.SetChunkHash(crc32.NewIEEE())
+	c.SetMaxChunkSize(2)
+	if out, err := c.ReadChunk(); err != chunkio.ErrChunkTooLarge || string(out) != "AB" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "AB", chunkio.ErrChunkTooLarge, out, err)
+	}
+	c.ResetFull()
+	if c.GetKey() != nil || c.ChunkCount() != 0 || c.Offset() != 2 || c.ChunkSum() != nil {
+		t.Errorf("ResetFull. Expected no key, count 0, offset 2 and no sum, got %q, %d, %d, %v", c.GetKey(), c.ChunkCount(), c.Offset(), c.ChunkSum())
+	}
+	if out, err := c.ReadChunk(); err != nil || string(out) != "c;def;ghi" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "c;def;ghi", nil, out, err)
+	}
+	c.Close()
+	c.ResetFull()
+	if _, err := c.ReadChunk(); err != chunkio.ErrClosed {
+		t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrClosed, err)
+	}
+}
+
+func TestShortNextChunk(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader(`{"a":1}` + "\n" + `{"a":2}` + "\n"))
+	c.SetKey([]byte("\n"))
+	for _, want := range []int{1, 2} {
+		var v struct{ A int }
+		if err := json.NewDecoder(c.NextChunk()).Decode(&v); err != nil || v.A != want {
+			t.Errorf("NextChunk. Expected %d (err %v), got %d (err %v)", want, nil, v.A, err)
+		}
+		if _, err := ioutil.ReadAll(c.NextChunk()); err != nil {
+			t.Errorf("ReadAll. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+	}
+	if _, err := ioutil.ReadAll(c.NextChunk()); err != chunkio.ErrKeyNotFound {
+		t.Errorf("ReadAll. Expected error code \"%v\", got \"%v\"", chunkio.ErrKeyNotFound, err)
+	}
+}
+
+func TestShortForEachChunk(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("a;bc;d"))
+	c.SetKey([]byte(";"))
+	var out []string
+	err := c.ForEachChunk(func(chunk []byte) error {
+		out = append(out, fmt.Sprintf("%s/%v", chunk, c.Complete()))
+		return nil
+	})
+	if want := "a/true|bc/true|d/false"; err != nil || strings.Join(out, "|") != want {
+		t.Errorf("ForEachChunk. Expected %q (err %v), got %q (err %v)", want, nil, strings.Join(out, "|"), err)
+	}
+
+	errStop := errors.New("stop")
+	c = chunkio.NewReader(strings.NewReader("a;bc;d"))
+	c.SetKey([]byte(";"))
+	n := 0
+	err = c.ForEachChunk(func(chunk []byte) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Errorf("ForEachChunk. Expected 1 call (err %v), got %d (err %v)", errStop, n, err)
+	}
+}
+
+func TestShortReadAllChunks(t *testing.T) {
+	cases := []struct {
+		in  string
+		max int
+		out []string
+		err error
+	}{
+		{"a;bc;;d", 0, []string{"a", "bc", "", "d"}, chunkio.ErrKeyNotFound},
+		{"a;bc;", 0, []string{"a", "bc"}, nil},
+		{"", 0, nil, nil},
+		{"a;bcdef;g", 3, []string{"a"}, chunkio.ErrChunkTooLarge},
+	}
+	for _, tc := range cases {
+		c := chunkio.NewReader(strings.NewReader(tc.in))
+		c.SetKey([]byte(";"))
+		c.SetMaxChunkSize(tc.max)
+		out, err := c.ReadAllChunks()
+		if err != tc.err || fmt.Sprintf("%q", out) != fmt.Sprintf("%q", tc.out) {
+			t.Errorf("ReadAllChunks(%q). Expected %q (err %v), got %q (err %v)", tc.in, tc.out, tc.err, out, err)
+		}
+	}
+}
+
+func TestShortSeekToChunk(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("a;bc;def;gh"))
+	c.SetKey([]byte(";"))
+	c.ReadChunk()
+	for _, want := range []struct {
+		n   int
+		out string
+		err error
+	}{{2, "def", nil}, {0, "a", nil}, {3, "gh", chunkio.ErrKeyNotFound}, {1, "bc", nil}} {
+		if err := c.SeekToChunk(want.n); err != nil {
+			t.Errorf("SeekToChunk(%d). Expected error code \"%v\", got \"%v\"", want.n, nil, err)
+		}
+		if c.ChunkCount() != want.n {
+			t.Errorf("ChunkCount. Expected %d, got %d", want.n, c.ChunkCount())
+		}
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+	}
+	if err := c.SeekToChunk(4); err != chunkio.ErrNoChunk {
+		t.Errorf("SeekToChunk(4). Expected error code \"%v\", got \"%v\"", chunkio.ErrNoChunk, err)
+	}
+	c = chunkio.NewReader(iotest.OneByteReader(strings.NewReader("a;b")))
+	c.SetKey([]byte(";"))
+	if err := c.SeekToChunk(1); err != chunkio.ErrNotSeekable {
+		t.Errorf("SeekToChunk(1). Expected error code \"%v\", got \"%v\"", chunkio.ErrNotSeekable, err)
+	}
+}
+
+func TestShortBuildIndex(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("a;bc;;def;gh"))
+	c.SetKey([]byte(";"))
+	idx, err := c.BuildIndex()
+	if want := []int64{0, 2, 5, 6, 10}; err != nil || fmt.Sprint(idx) != fmt.Sprint(want) {
+		t.Errorf("BuildIndex. Expected %v (err %v), got %v (err %v)", want, nil, idx, err)
+	}
+	for _, want := range []struct {
+		n   int
+		out string
+		err error
+	}{{3, "def", nil}, {0, "a", nil}, {4, "gh", chunkio.ErrKeyNotFound}, {2, "", nil}} {
+		if err := c.SeekIndexed(idx, want.n); err != nil {
+			t.Errorf("SeekIndexed(%d). Expected error code \"%v\", got \"%v\"", want.n, nil, err)
+		}
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+	}
+	if err := c.SeekIndexed(idx, 5); err != chunkio.ErrNoChunk {
+		t.Errorf("SeekIndexed(5). Expected error code \"%v\", got \"%v\"", chunkio.ErrNoChunk, err)
+	}
+
+	// Data read before seeking is not part of the chunk sought to
+	c = chunkio.NewReader(strings.NewReader("hello;world;"))
+	c.SetKey([]byte(";"))
+	idx, _ = c.BuildIndex()
+	c.SetRetainChunks(true)
+	c.SetChunkHash(crc32.NewIEEE())
+	c.SeekIndexed(idx, 0)
+	c.Read(make([]byte, 2))
+	c.SeekIndexed(idx, 1)
+	ioutil.ReadAll(c)
+	if string(c.LastChunk()) != "world" {
+		t.Errorf("LastChunk. Expected %q, got %q", "world", c.LastChunk())
+	}
+	if got, want := binary.BigEndian.Uint32(c.ChunkSum()), crc32.ChecksumIEEE([]byte("world")); got != want {
+		t.Errorf("ChunkSum. Expected %08x, got %08x", want, got)
+	}
+	c = chunkio.NewReader(strings.NewReader("a;b;"))
+	c.SetKey([]byte(";"))
+	if idx, err := c.BuildIndex(); err != nil || len(idx) != 2 {
+		t.Errorf("BuildIndex. Expected %v (err %v), got %v (err %v)", []int64{0, 2}, nil, idx, err)
+	}
+}
+
+func TestShortLastChunks(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("a;bc;;def;gh"))
+	c.SetKey([]byte(";"))
+	for _, want := range []struct {
+		n   int
+		out []string
+	}{{0, nil}, {2, []string{"gh", "def"}}, {4, []string{"gh", "def", "", "bc"}}, {9, []string{"gh", "def", "", "bc", "a"}}} {
+		out, err := c.LastChunks(want.n)
+		if err != nil || fmt.Sprintf("%q", out) != fmt.Sprintf("%q", want.out) {
+			t.Errorf("LastChunks(%d). Expected %q (err %v), got %q (err %v)", want.n, want.out, nil, out, err)
+		}
+	}
+	if c.Offset() != 12 {
+		t.Errorf("Offset. Expected %d, got %d", 12, c.Offset())
+	}
+
+	// Keys across the windows read backward
+	var s strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&s, "%s%d<=>", strings.Repeat("x", i%23), i)
+	}
+	c = chunkio.NewReaderSize(strings.NewReader(s.String()), 16)
+	c.SetKeys([]byte("<=>"), []byte("=>"))
+	out, err := c.LastChunks(45)
+	if err != nil || len(out) != 45 {
+		t.Fatalf("LastChunks(45). Expected %d chunks (err %v), got %d (err %v)", 45, nil, len(out), err)
+	}
+	for i, chunk := range out {
+		if want := fmt.Sprintf("%s%d", strings.Repeat("x", (49-i)%23), 49-i); string(chunk) != want {
+			t.Errorf("LastChunks. Expected chunk %d to be %q, got %q", i, want, chunk)
+		}
+	}
+
+	c = chunkio.NewReader(bytes.NewBufferString("a;b"))
+	c.SetKey([]byte(";"))
+	if _, err := c.LastChunks(1); err != chunkio.ErrNotSeekable {
+		t.Errorf("LastChunks. Expected error code \"%v\", got \"%v\"", chunkio.ErrNotSeekable, err)
+	}
+	c.SetKey(nil)
+	if _, err := c.LastChunks(1); err != chunkio.ErrInvalidKey {
+		t.Errorf("LastChunks. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidKey, err)
+	}
+}
+
+func TestShortAnalyze(t *testing.T) {
+	cases := []struct {
+		desc string
+		in   string
+		want chunkio.ChunkioStats
+	}{
+		{"Trailing key", "a;bcd;;ef;", chunkio.ChunkioStats{Count: 4, TotalBytes: 6, MinSize: 0, MaxSize: 3, FinalTerminated: true}},
+		{"No trailing key", "ab;cdef", chunkio.ChunkioStats{Count: 2, TotalBytes: 6, MinSize: 2, MaxSize: 4}},
+		{"Empty stream", "", chunkio.ChunkioStats{}},
+	}
+	for _, c := range cases {
+		r := chunkio.NewReader(strings.NewReader(c.in))
+		r.SetKey([]byte(";"))
+		s, err := r.Analyze()
+		if err != nil || s != c.want {
+			t.Errorf("Case %q. Expected %+v (err %v), got %+v (err %v)", c.desc, c.want, nil, s, err)
+		}
+		// The stream is rewound
+		if out, err := r.ReadChunk(); len(c.in) > 0 && string(out) != c.in[:strings.IndexAny(c.in+";", ";")] {
+			t.Errorf("Case %q. Expected first chunk after Analyze, got %q (err %v)", c.desc, out, err)
+		}
+	}
+	if s := (chunkio.ChunkioStats{Count: 4, TotalBytes: 6}); s.MeanSize() != 1.5 {
+		t.Errorf("MeanSize. Expected %v, got %v", 1.5, s.MeanSize())
+	}
+
+	// A stream that cannot be rewound is consumed
+	r := chunkio.NewReader(bytes.NewBufferString("a;bcd;ef"))
+	r.SetKey([]byte(";"))
+	r.ReadChunk()
+	r.Reset()
+	want := chunkio.ChunkioStats{Count: 2, TotalBytes: 5, MinSize: 2, MaxSize: 3}
+	if s, err := r.Analyze(); err != nil || s != want {
+		t.Errorf("Analyze. Expected %+v (err %v), got %+v (err %v)", want, nil, s, err)
+	}
+	if _, err := r.ReadChunk(); err != chunkio.ErrKeyNotFound {
+		t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrKeyNotFound, err)
+	}
+}
+
+func TestShortSetMinChunkSize(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader("ab;;abc;"+strings.Repeat("x", 40)+";a;abcd;ab"), 16)
+	c.SetKey([]byte(";"))
+	c.SetMinChunkSize(3)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", nil}, {strings.Repeat("x", 40), nil}, {"abcd", nil}, {"ab", chunkio.ErrKeyNotFound}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	if c.ChunkCount() != 3 {
+		t.Errorf("ChunkCount. Expected %d, got %d", 3, c.ChunkCount())
+	}
+
+	c = chunkio.NewReader(strings.NewReader("a;;bc;d;"))
+	c.SetKey([]byte(";"))
+	c.SetKeepKey(true)
+	c.SetMinChunkSize(2)
+	if out, err := c.ReadAllChunks(); err != nil || fmt.Sprintf("%q", out) != `["a;" "bc;" "d;"]` {
+		t.Errorf("ReadAllChunks. Expected %q (err %v), got %q (err %v)", []string{"a;", "bc;", "d;"}, nil, out, err)
+	}
+}
+
+func TestShortSetSkipEmpty(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("---\n---\na\n---\n---\n---\nb\n---\n"))
+	c.SetKey([]byte("---\n"))
+	c.SetSkipEmpty(true)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"a\n", nil}, {"b\n", nil}, {"", chunkio.ErrKeyNotFound}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	if c.ChunkCount() != 2 {
+		t.Errorf("ChunkCount. Expected %d, got %d", 2, c.ChunkCount())
+	}
+}
+
+type failWriter struct{}
+
+var errFailWriter = errors.New("write failed")
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errFailWriter
+}
+
+func TestShortSetSkipLeadingKey(t *testing.T) {
+	cases := []struct {
+		in     string
+		chunks []string
+	}{
+		{"---\na\n---\n---\nb\n", []string{"a\n", "", "b\n"}},
+		{"a\n---\n---\nb\n", []string{"a\n", "", "b\n"}},
+		{"---\n---\n", []string{""}},
+	}
+	for _, x := range cases {
+		c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader(x.in)), 16)
+		c.SetKey([]byte("---\n"))
+		c.SetSkipLeadingKey(true)
+		var out []string
+		for chunk, err := range c.Chunks() {
+			if err != nil && err != chunkio.ErrKeyNotFound {
+				t.Errorf("Input %q. Expected error code \"%v\", got \"%v\"", x.in, nil, err)
+			}
+			out = append(out, string(chunk))
+		}
+		if strings.Join(out, "|") != strings.Join(x.chunks, "|") || len(out) != len(x.chunks) {
+			t.Errorf("Input %q. Expected chunks %q, got %q", x.in, x.chunks, out)
+		}
+	}
+}
+
+func TestShortUnderlyingError(t *testing.T) {
+	errRead := errors.New("read failed")
+	c := chunkio.NewReader(io.MultiReader(strings.NewReader("abc;de"), iotest.ErrReader(errRead)))
+	c.SetKey([]byte(";"))
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", nil}, {"de", errRead}, {"", errRead}} {
+		out, err := c.ReadChunk()
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	if _, err := c.Peek(1); err != errRead {
+		t.Errorf("Peek. Expected error code \"%v\", got \"%v\"", errRead, err)
+	}
+}
+
+// dataErr returns all of its data together with err in a single Read.
+type dataErr struct {
+	data string
+	err  error
+}
+
+func (d *dataErr) Read(p []byte) (int, error) {
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	if len(d.data) > 0 {
+		return n, nil
+	}
+	return n, d.err
+}
+
+// stalled returns data and then no data and no error forever.
+type stalled struct {
+	data string
+}
+
+func (s *stalled) Read(p []byte) (int, error) {
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func TestShortNoProgress(t *testing.T) {
+	c := chunkio.NewReader(&stalled{"ab;cd"})
+	c.SetKey([]byte(";"))
+	if out, err := c.ReadChunk(); err != nil || string(out) != "ab" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "ab", nil, out, err)
+	}
+	c.Reset()
+	if out, err := c.ReadChunk(); err != io.ErrNoProgress || string(out) != "cd" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "cd", io.ErrNoProgress, out, err)
+	}
+	c = chunkio.NewReader(&stalled{"ab"})
+	if out, err := c.ReadChunk(); err != io.ErrNoProgress || string(out) != "ab" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "ab", io.ErrNoProgress, out, err)
+	}
+	c = chunkio.NewReader(&stalled{"ab"})
+	if n, err := c.WriteTo(io.Discard); err != io.ErrNoProgress || n != 2 {
+		t.Errorf("WriteTo. Expected %d bytes (err %v), got %d (err %v)", 2, io.ErrNoProgress, n, err)
+	}
+}
+
+func TestShortDataWithError(t *testing.T) {
+	errRead := errors.New("read failed")
+	for _, rd := range []io.Reader{
+		iotest.DataErrReader(strings.NewReader("abc;;de;;")),
+		iotest.DataErrReader(iotest.OneByteReader(strings.NewReader("abc;;de;;"))),
+		&dataErr{"abc;;de;;", errRead},
+	} {
+		c := chunkio.NewReader(rd)
+		c.SetKey([]byte(";;"))
+		for _, want := range []string{"abc", "de"} {
+			out, err := c.ReadChunk()
+			if err != nil || string(out) != want {
+				t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+			}
+			c.Reset()
+		}
+		if c.ChunkCount() != 2 || !c.Complete() {
+			t.Errorf("ChunkCount. Expected %d complete chunks, got %d (complete %v)", 2, c.ChunkCount(), c.Complete())
+		}
+	}
+
+	c := chunkio.NewReader(&dataErr{"abc;de", errRead})
+	c.SetKey([]byte(";"))
+	c.ReadChunk()
+	c.Reset()
+	c.SetKey(nil)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"de", nil}, {"", errRead}, {"", errRead}} {
+		p := make([]byte, 10)
+		n, err := c.Read(p)
+		if err != want.err || string(p[:n]) != want.out {
+			t.Errorf("Read. Expected %q (err %v), got %q (err %v)", want.out, want.err, p[:n], err)
+		}
+	}
+}
+
+// Data read before an error of the underlying Reader is delivered once the key
+// is cleared, wherever the key is cleared.
+func TestShortResidualAfterError(t *testing.T) {
+	errRead := errors.New("read failed")
+	for _, want := range []struct {
+		desc string
+		set  func(c *chunkio.Reader)
+		out  string
+	}{
+		{"After Peek", func(c *chunkio.Reader) { c.Peek(2) }, "abc;de"},
+		{"Within chunk", func(c *chunkio.Reader) { c.Read(make([]byte, 2)) }, "c;de"},
+		{"After Reset", func(c *chunkio.Reader) { c.ReadChunk(); c.Reset() }, "de"},
+		{"After chunk too large", func(c *chunkio.Reader) { c.SetMaxChunkSize(2); c.ReadChunk(); c.Reset() }, "c;de"},
+	} {
+		c := chunkio.NewReader(&dataErr{"abc;de", errRead})
+		c.SetKey([]byte(";"))
+		want.set(c)
+		c.SetKey(nil)
+		out, err := ioutil.ReadAll(c)
+		if err != errRead || string(out) != want.out {
+			t.Errorf("Case %q. Expected %q (err %v), got %q (err %v)", want.desc, want.out, errRead, out, err)
+		}
+	}
+}
+
+func TestShortSetEagerEOF(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;defgh"))
+	c.SetKey([]byte(";"))
+	c.SetEagerEOF(true)
+	p := make([]byte, 10)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", io.EOF}, {"defgh", nil}, {"", chunkio.ErrKeyNotFound}} {
+		n, err := c.Read(p)
+		if err != want.err || string(p[:n]) != want.out {
+			t.Errorf("Read. Expected %q (err %v), got %q (err %v)", want.out, want.err, p[:n], err)
+		}
+		if err == io.EOF {
+			c.Reset()
+		}
+	}
+	c = chunkio.NewReader(strings.NewReader("abcdef;gh"))
+	c.SetKey([]byte(";"))
+	c.SetEagerEOF(true)
+	if out, err := ioutil.ReadAll(c); err != nil || string(out) != "abcdef" {
+		t.Errorf("ReadAll. Expected %q (err %v), got %q (err %v)", "abcdef", nil, out, err)
+	}
+}
+
+func TestShortSetChunkHash(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader("abc;"+strings.Repeat("x", 40)+";;de"), 16)
+	c.SetKey([]byte(";"))
+	c.SetChunkHash(crc32.NewIEEE())
+	if c.ChunkSum() != nil {
+		t.Errorf("ChunkSum. Expected %v, got %v", nil, c.ChunkSum())
+	}
+	c.ReadByte()
+	c.UnreadByte()
+	var sums []uint32
+	for chunk, err := range c.Chunks() {
+		if err != nil && err != chunkio.ErrKeyNotFound {
+			t.Errorf("Chunks. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+		if got, want := binary.BigEndian.Uint32(c.ChunkSum()), crc32.ChecksumIEEE(chunk); got != want {
+			t.Errorf("ChunkSum(%q). Expected %08x, got %08x", chunk, want, got)
+		}
+		sums = append(sums, binary.BigEndian.Uint32(c.ChunkSum()))
+	}
+	if len(sums) != 4 {
+		t.Errorf("Chunks. Expected %d chunks, got %d", 4, len(sums))
+	}
+
+	c = chunkio.NewReader(strings.NewReader("abc;def"))
+	c.SetKey([]byte(";"))
+	c.SetKeepKey(true)
+	c.SetChunkHash(crc32.NewIEEE())
+	c.Discard(1)
+	c.SkipChunk()
+	if got, want := binary.BigEndian.Uint32(c.ChunkSum()), crc32.ChecksumIEEE([]byte("abc;")); got != want {
+		t.Errorf("ChunkSum. Expected %08x, got %08x", want, got)
+	}
+}
+
+func TestShortSetEOFTerminates(t *testing.T) {
+	for _, in := range []string{"a;bc;def", "a;bc;def;"} {
+		c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader(in)), 16)
+		c.SetKey([]byte(";"))
+		c.SetEOFTerminates(true)
+		for _, want := range []string{"a", "bc", "def"} {
+			if out, err := c.ReadChunk(); err != nil || string(out) != want || !c.Complete() {
+				t.Errorf("Input %q. Expected %q (err %v), got %q (err %v, complete %v)", in, want, nil, out, err, c.Complete())
+			}
+			c.Reset()
+		}
+		if out, err := c.ReadChunk(); err != chunkio.ErrKeyNotFound || len(out) != 0 {
+			t.Errorf("Input %q. Expected %q (err %v), got %q (err %v)", in, "", chunkio.ErrKeyNotFound, out, err)
+		}
+		if c.ChunkCount() != 3 {
+			t.Errorf("ChunkCount. Expected %d, got %d", 3, c.ChunkCount())
+		}
+	}
+	c := chunkio.NewReader(strings.NewReader("a;bc"))
+	c.SetKey([]byte(";"))
+	c.SetEOFTerminates(true)
+	c.SkipChunk()
+	c.Reset()
+	if out, err := c.ReadString(); err != nil || out != "bc" {
+		t.Errorf("ReadString. Expected %q (err %v), got %q (err %v)", "bc", nil, out, err)
+	}
+	c.Reset()
+	if chunks, err := c.ReadAllChunks(); err != nil || len(chunks) != 0 {
+		t.Errorf("ReadAllChunks. Expected %q (err %v), got %q (err %v)", []string{}, nil, chunks, err)
+	}
+}
+
+func TestShortSetTransform(t *testing.T) {
+	upper := func(p []byte) {
+		copy(p, bytes.ToUpper(p))
+	}
+	c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader("abc;def;ghi;jkl")), 16)
+	c.SetKey([]byte(";"))
+	c.SetTransform(upper)
+	if out, err := c.ReadChunk(); err != nil || string(out) != "ABC" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "ABC", nil, out, err)
+	}
+	c.Reset()
+	c.SetKeepKey(true)
+	c.SetKey([]byte("f;"))
+	if out, err := c.ReadChunk(); err != nil || string(out) != "DEf;" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "DEf;", nil, out, err)
+	}
+	c.Reset()
+	c.SetKeepKey(false)
+	c.SetKey([]byte(";"))
+	if out, err := c.ReadString(); err != nil || out != "GHI" {
+		t.Errorf("ReadString. Expected %q (err %v), got %q (err %v)", "GHI", nil, out, err)
+	}
+	c.Reset()
+	c.SetKey(nil)
+	if out, err := c.ReadChunk(); err != nil || string(out) != "jkl" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "jkl", nil, out, err)
+	}
+}
+
+// Test that state broken by a read from within a transform, which uses up the
+// key that SetEagerEOF is about to discard, is reported instead of panicking.
+func TestShortErrInternal(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;"))
+	c.SetKey([]byte(";"))
+	c.SetEagerEOF(true)
+	c.SetTransform(func(p []byte) {
+		c.SetTransform(nil)
+		c.Read(make([]byte, 1))
+	})
+	if _, err := c.Read(make([]byte, 10)); !errors.Is(err, chunkio.ErrInternal) {
+		t.Errorf("Read. Expected error code \"%v\", got \"%v\"", chunkio.ErrInternal, err)
+	}
+	if err := c.GetErr(); !errors.Is(err, chunkio.ErrInternal) {
+		t.Errorf("GetErr. Expected error code \"%v\", got \"%v\"", chunkio.ErrInternal, err)
+	}
+}
+
+func TestShortSetChunkDecoder(t *testing.T) {
+	want := []string{"hello", "", strings.Repeat("chunkio ", 10), "x"}
+	var in strings.Builder
+	for _, chunk := range want {
+		in.WriteString(base64.StdEncoding.EncodeToString([]byte(chunk)) + "\n")
+	}
+	for _, rd := range []io.Reader{strings.NewReader(in.String()), iotest.OneByteReader(strings.NewReader(in.String()))} {
+		c := chunkio.NewReaderSize(rd, 16)
+		c.SetKey([]byte("\n"))
+		if err := c.SetChunkDecoder(4, base64.StdEncoding.Decode); err != nil {
+			t.Fatalf("SetChunkDecoder. Expected error code \"%v\", got \"%v\"", nil, err)
+		}
+		for _, chunk := range want {
+			out, err := c.ReadChunk()
+			if err != nil || string(out) != chunk {
+				t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", chunk, nil, out, err)
+			}
+			c.Reset()
+		}
+	}
+
+	// Reads smaller than the decoded units
+	c := chunkio.NewReaderSize(strings.NewReader("6869;2a2B2c;7"), 16)
+	c.SetKey([]byte(";"))
+	c.SetChunkDecoder(2, hex.Decode)
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"hi", nil}, {"*+,", nil}, {"", hex.ErrLength}} {
+		var out []byte
+		var err error
+		for {
+			var b byte
+			if b, err = c.ReadByte(); err != nil {
+				break
+			}
+			out = append(out, b)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadByte. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+	if err := c.SetChunkDecoder(0, hex.Decode); err != chunkio.ErrInvalidDecoder {
+		t.Errorf("SetChunkDecoder. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidDecoder, err)
+	}
+}
+
+func TestShortSetRetainChunks(t *testing.T) {
+	c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader("abc;;d;xyz")), 16)
+	c.SetKey([]byte(";"))
+	c.SetRetainChunks(true)
+	if c.LastChunk() != nil {
+		t.Errorf("LastChunk. Expected %v, got %q", nil, c.LastChunk())
+	}
+	p := make([]byte, 2)
+	c.Read(p)
+	c.ReadByte()
+	c.UnreadByte()
+	io.ReadFull(c, p)
+	if string(c.LastChunk()) != "abc" {
+		t.Errorf("LastChunk. Expected %q, got %q", "abc", c.LastChunk())
+	}
+	last := c.LastChunk()
+	for _, want := range []string{"", "d", "xyz"} {
+		c.Reset()
+		c.ReadString()
+		if got := c.LastChunk(); string(got) != want || got == nil {
+			t.Errorf("LastChunk. Expected %q, got %q", want, got)
+		}
+	}
+	if string(last) != "abc" {
+		t.Errorf("LastChunk. Expected %q to be kept, got %q", "abc", last)
+	}
+	c.SetRetainChunks(false)
+	if c.LastChunk() != nil {
+		t.Errorf("LastChunk. Expected %v, got %q", nil, c.LastChunk())
+	}
+}
+
+func TestShortSetTee(t *testing.T) {
+	var tee bytes.Buffer
+	c := chunkio.NewReader(strings.NewReader("abc;def;ghi"))
+	c.SetKey([]byte(";"))
+	c.SetTee(&tee)
+	if out, err := c.ReadChunk(); err != nil || string(out) != "abc" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "abc", nil, out, err)
+	}
+	c.Reset()
+	c.SetKey(nil)
+	if out, err := c.ReadChunk(); err != nil || string(out) != "def;ghi" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "def;ghi", nil, out, err)
+	}
+	if tee.String() != "abc;def;ghi" {
+		t.Errorf("SetTee. Expected %q, got %q", "abc;def;ghi", tee.String())
+	}
+
+	c = chunkio.NewReader(strings.NewReader("abc;def"))
+	c.SetKey([]byte(";"))
+	c.SetTee(failWriter{})
+	if _, err := c.Read(make([]byte, 10)); err != errFailWriter {
+		t.Errorf("Read. Expected error code \"%v\", got \"%v\"", errFailWriter, err)
+	}
+	c.Reset()
+	if _, err := c.Read(make([]byte, 10)); err != errFailWriter {
+		t.Errorf("Read. Expected error code \"%v\", got \"%v\"", errFailWriter, err)
+	}
+}
+
+func TestShortSetMarker(t *testing.T) {
+	in := "ab<3c;<3<3" + strings.Repeat("x", 40) + "<<33;d<3;<3<<<3<<<"
+	for _, marker := range []string{"<3", "<<", "3;d<3;"} {
+		var want []int64
+		for i := 0; strings.Contains(in[i:], marker); i += len(marker) {
+			i += strings.Index(in[i:], marker)
+			want = append(want, int64(i))
+		}
+		for _, rd := range []io.Reader{strings.NewReader(in), iotest.OneByteReader(strings.NewReader(in)), iotest.HalfReader(strings.NewReader(in))} {
+			c := chunkio.NewReaderSize(rd, 16)
+			c.SetKey([]byte(";"))
+			var got []int64
+			c.SetMarker([]byte(marker), func(off int64) { got = append(got, off) })
+			var out []string
+			for chunk, err := range c.Chunks() {
+				if err != nil && err != chunkio.ErrKeyNotFound {
+					t.Fatalf("Chunks. Expected error code \"%v\", got \"%v\"", nil, err)
+				}
+				out = append(out, string(chunk))
+			}
+			if strings.Join(out, ";") != in {
+				t.Errorf("Chunks. Expected %q, got %q", in, strings.Join(out, ";"))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("SetMarker(%q). Expected offsets %v, got %v", marker, want, got)
+			}
+		}
+	}
+}
+
+func TestShortSetTrace(t *testing.T) {
+	var trace bytes.Buffer
+	c := chunkio.NewReader(strings.NewReader("abc;def"))
+	c.SetKey([]byte(";"))
+	c.SetTrace(&trace)
+	p := make([]byte, 2)
+	c.Read(p)
+	c.SetTrace(nil)
+	c.Read(p)
+	want := "chunkio: read n=2 err=<nil> buf=5 scan=1 found=true match=1\n"
+	if trace.String() != want {
+		t.Errorf("SetTrace. Expected %q, got %q", want, trace.String())
+	}
+}
+
+func TestShortReadChunk(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789"), 1000)
+	cases := []struct {
+		desc string
+		in   []byte
+		key  []byte
+		out  [][]byte
+		err  []error
+	}{
+		{
+			desc: "Two chunks and trailer",
+			in:   []byte("abc;;def;;ghi"),
+			key:  []byte(";;"),
+			out:  [][]byte{[]byte("abc"), []byte("def"), []byte("ghi"), []byte("")},
+			err:  []error{nil, nil, chunkio.ErrKeyNotFound, chunkio.ErrKeyNotFound},
+		},
+		{
+			desc: "Long chunk without key",
+			in:   long,
+			key:  []byte(";;"),
+			out:  [][]byte{long, []byte("")},
+			err:  []error{chunkio.ErrKeyNotFound, chunkio.ErrKeyNotFound},
+		},
+	}
+	for _, c := range cases {
+		rd := chunkio.NewReader(bytes.NewReader(c.in))
+		rd.SetKey(c.key)
+		for i := range c.out {
+			out, err := rd.ReadChunk()
+			if c.err[i] != err {
+				t.Errorf("Case %q chunk %d. Expected error=\"%v\", got \"%v\"", c.desc, i, c.err[i], err)
+			}
+			if bytes.Compare(c.out[i], out) != 0 {
+				t.Errorf("Case %q chunk %d. Expected chunk=%q, got %q", c.desc, i, c.out[i], out)
+			}
+			rd.Reset()
+		}
+	}
+}
+
+func TestShortChunkWithKey(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("the quick {U}brown fox{L} jumps"))
+	for _, want := range []struct {
+		key string
+		out string
+		err error
+	}{
+		{"{U}", "the quick ", nil},
+		{"", "", chunkio.ErrInvalidKey},
+		{"{L}", "brown fox", nil},
+		{"{U}", " jumps", chunkio.ErrKeyNotFound},
+	} {
+		out, err := c.ChunkWithKey([]byte(want.key))
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ChunkWithKey(%q). Expected %q (err %v), got %q (err %v)", want.key, want.out, want.err, out, err)
+		}
+	}
+}
+
+func TestShortReadChunkInto(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abcdef;gh;;ijk"))
+	c.SetKey([]byte(";"))
+	dst := make([]byte, 3)
+	for _, want := range []struct {
+		out   string
+		whole bool
+		err   error
+	}{{"abc", false, nil}, {"def", true, nil}, {"gh", true, nil}, {"", true, nil}, {"ijk", true, chunkio.ErrKeyNotFound}} {
+		n, whole, err := c.ReadChunkInto(dst)
+		if err != want.err || whole != want.whole || string(dst[:n]) != want.out {
+			t.Errorf("ReadChunkInto. Expected %q, %v (err %v), got %q, %v (err %v)", want.out, want.whole, want.err, dst[:n], whole, err)
+		}
+		if whole {
+			c.Reset()
+		}
+	}
+}
+
+func TestShortErrKeyNotFound(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc"))
+	c.SetKey([]byte(";"))
+	_, err := c.ReadChunk()
+	if !errors.Is(err, chunkio.ErrKeyNotFound) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrKeyNotFound, err)
+	}
+	// Callers comparing with the error returned before still match
+	if err != chunkio.ErrKeyNotFound || err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadChunk. Expected error code \"%v\", got \"%v\"", io.ErrUnexpectedEOF, err)
+	}
+	c = chunkio.NewReader(strings.NewReader("---\nauthor : Jason"))
+	c.SetKey([]byte("---\n"))
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"", nil}, {"author : Jason", chunkio.ErrKeyNotFound}} {
+		out, err := ioutil.ReadAll(c)
+		if err != want.err || string(out) != want.out {
+			t.Errorf("ReadAll. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+}
+
+func TestShortReadString(t *testing.T) {
+	c := chunkio.NewReader(strings.NewReader("abc;def"))
+	c.SetKey([]byte(";"))
+	for _, want := range []struct {
+		out string
+		err error
+	}{{"abc", nil}, {"def", chunkio.ErrKeyNotFound}} {
+		out, err := c.ReadString()
+		if err != want.err || out != want.out {
+			t.Errorf("ReadString. Expected %q (err %v), got %q (err %v)", want.out, want.err, out, err)
+		}
+		c.Reset()
+	}
+}
+
+func TestShortReadByte(t *testing.T) {
+	in := []byte{0xac, 0x02, 0xff, 0xff, 0x01}
+	c := chunkio.NewReader(bytes.NewReader(in))
+	c.SetKey([]byte{0xff, 0xff})
+	v, err := binary.ReadUvarint(c)
+	if v != 300 || err != nil {
+		t.Errorf("ReadUvarint. Expected %d (err %v), got %d (err %v)", 300, nil, v, err)
+	}
+	if _, err := c.ReadByte(); err != io.EOF {
+		t.Errorf("ReadByte. Expected error code \"%v\", got \"%v\"", io.EOF, err)
+	}
+	c.Reset()
+	if b, err := c.ReadByte(); b != 0x01 || err != nil {
+		t.Errorf("ReadByte. Expected %d (err %v), got %d (err %v)", 0x01, nil, b, err)
+	}
+	if _, err := c.ReadByte(); err != chunkio.ErrKeyNotFound {
+		t.Errorf("ReadByte. Expected error code \"%v\", got \"%v\"", chunkio.ErrKeyNotFound, err)
+	}
+}
+
+func TestShortDiscard(t *testing.T) {
+	c := chunkio.NewReaderSize(strings.NewReader(strings.Repeat("x", 100)+"abc;def"), 16)
+	c.SetKey([]byte(";"))
+	for _, want := range []struct {
+		n    int
+		done int
+		err  error
+		next string
+	}{{98, 98, nil, "x"}, {5, 4, io.EOF, ""}, {-1, 0, chunkio.ErrNegativeCount, ""}} {
+		n, err := c.Discard(want.n)
+		if n != want.done || err != want.err {
+			t.Errorf("Discard(%d). Expected %d (err %v), got %d (err %v)", want.n, want.done, want.err, n, err)
+		}
+		if want.next != "" {
+			if b, _ := c.ReadByte(); string(b) != want.next {
+				t.Errorf("ReadByte. Expected %q, got %q", want.next, b)
+			}
+		}
+	}
+	c.Reset()
+	if n, err := c.Discard(5); n != 3 || err != chunkio.ErrKeyNotFound {
+		t.Errorf("Discard(5). Expected %d (err %v), got %d (err %v)", 3, chunkio.ErrKeyNotFound, n, err)
+	}
+	c = chunkio.NewReader(strings.NewReader("abcdef"))
+	if n, err := c.Discard(4); n != 4 || err != nil {
+		t.Errorf("Discard(4). Expected %d (err %v), got %d (err %v)", 4, nil, n, err)
+	}
+	if n, err := c.Discard(4); n != 2 || err != io.EOF {
+		t.Errorf("Discard(4). Expected %d (err %v), got %d (err %v)", 2, io.EOF, n, err)
+	}
+}
+
+func TestShortUnreadByte(t *testing.T) {
+	c := chunkio.NewReader(bytes.NewReader([]byte("ab;cd")))
+	c.SetKey([]byte(";"))
+	if err := c.UnreadByte(); err != chunkio.ErrInvalidUnreadByte {
+		t.Errorf("UnreadByte. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidUnreadByte, err)
+	}
+	c.ReadByte()
+	c.ReadByte()
+	if err := c.UnreadByte(); err != nil {
+		t.Errorf("UnreadByte. Expected error code \"%v\", got \"%v\"", nil, err)
+	}
+	if err := c.UnreadByte(); err != chunkio.ErrInvalidUnreadByte {
+		t.Errorf("UnreadByte. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidUnreadByte, err)
+	}
+	if out, err := c.ReadChunk(); err != nil || string(out) != "b" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "b", nil, out, err)
+	}
+	c.Reset()
+	c.SetKey(nil)
+	c.ReadByte()
+	c.UnreadByte()
+	if out, err := c.ReadChunk(); err != nil || string(out) != "cd" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "cd", nil, out, err)
+	}
+
+	// Decoded bytes and the last byte of a chunk ended by SetEagerEOF cannot be
+	// unread, and the stream is left as it was
+	for _, mode := range []struct {
+		desc string
+		in   string
+		set  func(c *chunkio.Reader)
+	}{
+		{"SetUnescape", "ab;cd", func(c *chunkio.Reader) { c.SetUnescape([]byte("\\")) }},
+		{"SetChunkDecoder", "6162;6364", func(c *chunkio.Reader) { c.SetChunkDecoder(2, hex.Decode) }},
+		{"SetEagerEOF", "ab;cd", func(c *chunkio.Reader) { c.SetEagerEOF(true) }},
+	} {
+		c = chunkio.NewReader(strings.NewReader(mode.in))
+		c.SetKey([]byte(";"))
+		mode.set(c)
+		c.ReadByte()
+		if b, err := c.ReadByte(); err != nil || b != 'b' {
+			t.Errorf("Case %q. Expected ReadByte %q (err %v), got %q (err %v)", mode.desc, 'b', nil, b, err)
+		}
+		if err := c.UnreadByte(); err != chunkio.ErrInvalidUnreadByte {
+			t.Errorf("Case %q. Expected error code \"%v\", got \"%v\"", mode.desc, chunkio.ErrInvalidUnreadByte, err)
+		}
+		if out, err := c.ReadChunk(); err != nil || string(out) != "" {
+			t.Errorf("Case %q. Expected ReadChunk %q (err %v), got %q (err %v)", mode.desc, "", nil, out, err)
+		}
+		c.Reset()
+		if out, err := c.ReadChunk(); err != chunkio.ErrKeyNotFound || string(out) != "cd" {
+			t.Errorf("Case %q. Expected ReadChunk %q (err %v), got %q (err %v)", mode.desc, "cd", chunkio.ErrKeyNotFound, out, err)
+		}
+	}
+
+	// Stepping back does not copy the buffer, so it adds no allocation
+	for _, key := range [][]byte{[]byte(";"), nil} {
+		c = chunkio.NewReader(strings.NewReader(strings.Repeat("x", 1000)))
+		c.SetKey(key)
+		read := testing.AllocsPerRun(100, func() { c.ReadByte() })
+		both := testing.AllocsPerRun(100, func() {
+			c.UnreadByte()
+			c.ReadByte()
+		})
+		if both != read {
+			t.Errorf("UnreadByte. Expected %v allocations, got %v", read, both)
+		}
+	}
+}
+
+func TestShortUnreadChunk(t *testing.T) {
+	c := chunkio.NewReader(bytes.NewReader([]byte("ab;cd;")))
+	c.SetKey([]byte(";"))
+	c.ReadByte()
+	if err := c.UnreadChunk([]byte("x")); err != chunkio.ErrInvalidUnreadChunk {
+		t.Errorf("UnreadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidUnreadChunk, err)
+	}
+	c.ReadChunk()
+	if err := c.UnreadChunk([]byte("ab")); err != nil {
+		t.Errorf("UnreadChunk. Expected error code \"%v\", got \"%v\"", nil, err)
+	}
+	if c.Offset() != 0 || c.ChunkCount() != 0 {
+		t.Errorf("UnreadChunk. Expected offset 0 and count 0, got %d and %d", c.Offset(), c.ChunkCount())
+	}
+	for _, want := range []string{"ab", "cd"} {
+		if out, err := c.ReadChunk(); err != nil || string(out) != want {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+		}
+		c.Reset()
+	}
+	if err := c.UnreadChunk([]byte("x;y")); err != nil {
+		t.Errorf("UnreadChunk. Expected error code \"%v\", got \"%v\"", nil, err)
+	}
+	if out, err := c.ReadChunk(); err != nil || string(out) != "x" {
+		t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", "x", nil, out, err)
+	}
+
+	var b bytes.Buffer
+	w := chunkio.NewWriter(&b, []byte(";"))
+	w.SetEscape([]byte("\\"))
+	w.WriteChunk([]byte("a;b"))
+	w.WriteChunk([]byte("c"))
+	w.Close()
+	c = chunkio.NewReader(&b)
+	c.SetKey([]byte(";"))
+	c.SetUnescape([]byte("\\"))
+	c.ReadChunk()
+	c.UnreadChunk([]byte("x;\\"))
+	for _, want := range []string{"x;\\", "c"} {
+		c.Reset()
+		if out, err := c.ReadChunk(); err != nil || string(out) != want {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+		}
+	}
+
+	c = chunkio.NewReader(bytes.NewReader([]byte{0, 2, 'a', 'b', 0, 1, 'c'}))
+	c.SetLengthPrefixed(binary.BigEndian, 2)
+	c.ReadChunk()
+	c.Reset()
+	c.UnreadChunk([]byte("xyz"))
+	for _, want := range []string{"xyz", "c"} {
+		if out, err := c.ReadChunk(); err != nil || string(out) != want {
+			t.Errorf("ReadChunk. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+		}
+		c.Reset()
+	}
+	if err := chunkio.NewReader(nil).UnreadChunk([]byte("x")); err != chunkio.ErrInvalidUnreadChunk {
+		t.Errorf("UnreadChunk. Expected error code \"%v\", got \"%v\"", chunkio.ErrInvalidUnreadChunk, err)
+	}
+}
+
+func TestShortReadRune(t *testing.T) {
+	// The key splits the encoding of "é" leaving a partial rune before it
+	in := append([]byte("añ§"), 0xc3, ';', 0xa9, 'z', 0xe2)
+	c := chunkio.NewReaderSize(bytes.NewReader(in), 16)
+	c.SetKey([]byte(";"))
+	for i, want := range []struct {
+		r    rune
+		size int
+		err  error
+	}{
+		{'a', 1, nil}, {'ñ', 2, nil}, {'§', 2, nil}, {utf8.RuneError, 1, nil}, {0, 0, io.EOF},
+		{utf8.RuneError, 1, nil}, {'z', 1, nil}, {utf8.RuneError, 1, nil}, {0, 0, chunkio.ErrKeyNotFound},
+	} {
+		r, size, err := c.ReadRune()
+		if r != want.r || size != want.size || err != want.err {
+			t.Errorf("ReadRune %d. Expected %q/%d (err %v), got %q/%d (err %v)", i, want.r, want.size, want.err, r, size, err)
+		}
+		if err == io.EOF {
+			c.Reset()
+		}
+	}
+
+	// Runes straddling the edge of the scanned part of the buffer
+	long := strings.Repeat("a€§", 100)
+	c = chunkio.NewReaderSize(strings.NewReader(long+";"), 16)
+	c.SetKey([]byte(";"))
+	var out []rune
+	for {
+		r, _, err := c.ReadRune()
+		if err != nil {
+			break
+		}
+		out = append(out, r)
+	}
+	if string(out) != long {
+		t.Errorf("ReadRune. Expected %q, got %q", long, string(out))
+	}
+}
+
+func TestShortWriteTo(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789"), 1000)
+	in := append(append(append([]byte{}, long...), []byte("<>abc<>")...), long...)
+	c := chunkio.NewReader(bytes.NewReader(in))
+	c.SetKey([]byte("<>"))
+	for i, want := range []struct {
+		out []byte
+		err error
+	}{{long, nil}, {[]byte("abc"), nil}, {long, chunkio.ErrKeyNotFound}} {
+		var b bytes.Buffer
+		n, err := io.Copy(&b, c)
+		if err != want.err {
+			t.Errorf("Chunk %d. Expected error=\"%v\", got \"%v\"", i, want.err, err)
+		}
+		if n != int64(len(want.out)) || bytes.Compare(b.Bytes(), want.out) != 0 {
+			t.Errorf("Chunk %d. Expected %d bytes, got %d", i, len(want.out), n)
+		}
+		c.Reset()
+	}
+}
+
+func TestShortWriteChunksTo(t *testing.T) {
+	c := chunkio.NewReaderSize(iotest.OneByteReader(strings.NewReader("ab;;cd;;;;ef;;gh")), 16)
+	c.SetKey([]byte(";;"))
+	c.ReadByte()
+	cases := []struct {
+		n   int
+		out string
+		err error
+	}{
+		{2, "b, cd", nil},
+		{0, "", nil},
+		{1, "", nil},
+		{5, "ef, gh", chunkio.ErrKeyNotFound},
+	}
+	for i, x := range cases {
+		var b bytes.Buffer
+		n, err := c.WriteChunksTo(&b, x.n, []byte(", "))
+		if err != x.err || b.String() != x.out || n != int64(len(x.out)) {
+			t.Errorf("Case %d. Expected %q (err %v), got %q (%d bytes, err %v)", i, x.out, x.err, b.String(), n, err)
+		}
+	}
+	c.Reset()
+	if n, err := c.WriteChunksTo(io.Discard, 1, nil); err != nil || n != 0 {
+		t.Errorf("WriteChunksTo. Expected %d bytes (err %v), got %d (err %v)", 0, nil, n, err)
+	}
+
+	c = chunkio.NewReader(strings.NewReader("a;b;"))
+	c.SetKey([]byte(";"))
+	var b bytes.Buffer
+	if n, err := c.WriteChunksTo(&b, 3, []byte("\n")); err != nil || b.String() != "a\nb" || n != 3 {
+		t.Errorf("WriteChunksTo. Expected %q (err %v), got %q (%d bytes, err %v)", "a\nb", nil, b.String(), n, err)
+	}
+}
+
+func TestShortWriteToTruncated(t *testing.T) {
+	in := "abc;" + strings.Repeat("x", 100) + ";partial"
+	for _, set := range []func(c *chunkio.Reader){
+		func(c *chunkio.Reader) {},
+		func(c *chunkio.Reader) { c.SetTransform(func(p []byte) {}) },
+		func(c *chunkio.Reader) { c.SetUnescape([]byte("\\")) },
+	} {
+		c := chunkio.NewReaderSize(iotest.HalfReader(strings.NewReader(in)), 16)
+		c.SetKey([]byte(";"))
+		set(c)
+		for _, want := range []struct {
+			out string
+			err error
+		}{{"abc", nil}, {strings.Repeat("x", 100), nil}, {"partial", chunkio.ErrKeyNotFound}} {
+			var b bytes.Buffer
+			n, err := c.WriteTo(&b)
+			if err != want.err || n != int64(len(want.out)) || b.String() != want.out {
+				t.Errorf("WriteTo. Expected %q (err %v), got %q (err %v)", want.out, want.err, b.String(), err)
+			}
+			c.Reset()
+		}
+	}
+}
+
+// Test each input length from zero up to a large number.
+func TestLongReadSizes(t *testing.T) {
+	for i := 0; i < 20000; i++ {
+		rd := chunkio.NewReader(bytes.NewReader(append(bytes.Repeat([]byte("X"), i), []byte(";;;")...)))
+		rd.SetKey([]byte(";;;"))
+		out, err := ioutil.ReadAll(rd)
+		if len(out) != i {
+			t.Errorf("Failed.  Read byte sequence size %d instead of %d", len(out), i)
+		}
+		if err != nil {
+			t.Errorf("Failed.  Attempted to read byte sequence size %q and got error %v", i, err)
+		}
+	}
+}
+
+// Test a large number of cases randomizing the following:
+// * key (length and contents)
+// * input data before key (length and contents)
+// * additional "garbage" data after key (length and contents)
+func TestLongReadRand(t *testing.T) {
+	const (
+		numcycles = 8000
+		maxinput  = 4096 * 10
+		maxread   = maxinput / 10
+		maxkey    = maxinput / 12
+	)
+
+	var (
+		key     []byte // Key sequence to use
+		input   []byte // Source sequence
+		output  []byte // Destination sequence
+		garbage []byte // Garbage sequence at end
+		readbuf []byte // Buffer to store each Read call in
+		num     int    // Number of bytes from Read
+		err     error  // Error return code from Read
+		cio     *chunkio.Reader
+	)
+
+	for i := 0; i < numcycles; i++ {
+		output = nil
+		key = make([]byte, rand.Intn(maxkey-1)+1)
+		rand.Read(key)
+
+		input = make([]byte, rand.Intn(maxinput-1)+1)
+		rand.Read(input)
+
+		// Make sure key doesn't exist in input stream
+		for {
+			p := bytes.Index(input, key)
+			if p == -1 {
+				break
+			}
+			input[p] = input[p] + 1
+		}
+
+		garbage = make([]byte, rand.Intn(maxinput-1)+1)
+		rand.Read(garbage)
+
+		cio = chunkio.NewReader(bytes.NewReader(append(append(input, key...), garbage...)))
+		cio.SetKey(key)
+		for {
+			readbuf = make([]byte, rand.Intn(maxread-1)+1)
+			num, err = cio.Read(readbuf)
+			if err == nil {
+				output = append(output, readbuf[:num]...)
+			} else {
+				break
+			}
+		}
+		if bytes.Compare(input, output) != 0 {
+			t.Errorf("Cycle %d failed. Input and output differ!", i)
+		}
+		if len(output) != len(input) {
+			t.Errorf("Cycle %d failed. Read size should be %d but was %d", i, len(input), len(output))
+		}
+	}
+}
+
+// Read a multi-megabyte chunk containing a rare key.
+func BenchmarkReadLongChunk(b *testing.B) {
+	in := append(bytes.Repeat([]byte("0123456789abcdef"), 1<<18), []byte("<END>")...)
+	p := make([]byte, 32*1024)
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		c := chunkio.NewReader(bytes.NewReader(in))
+		c.SetKey([]byte("<END>"))
+		for {
+			if _, err := c.Read(p); err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Read from an underlying reader that returns one byte per call.
+func BenchmarkReadOneByteReader(b *testing.B) {
+	in := append(bytes.Repeat([]byte("0123456789abcdef"), 1<<12), []byte("<END>")...)
+	p := make([]byte, 32*1024)
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c := chunkio.NewReader(iotest.OneByteReader(bytes.NewReader(in)))
+		c.SetKey([]byte("<END>"))
+		for {
+			if _, err := c.Read(p); err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Split a large buffer into short lines on a single byte key.
+func BenchmarkReadSingleByteKey(b *testing.B) {
+	in := bytes.Repeat([]byte("0123456789abcdef0123456789abcdef0123456789abcdef\n"), 1<<14)
+	p := make([]byte, 32*1024)
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		c := chunkio.NewReader(bytes.NewReader(in))
+		c.SetKey([]byte("\n"))
+		for {
+			if _, err := c.Read(p); err == io.EOF {
+				c.Reset()
+			} else if err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Read fields separated by any of several bytes.
+func BenchmarkReadAnyByteKey(b *testing.B) {
+	in := bytes.Repeat([]byte("0123456789abcdef,0123456789abcdef\t0123456789abcdef;"), 1<<14)
+	p := make([]byte, 32*1024)
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		c := chunkio.NewReader(bytes.NewReader(in))
+		c.SetKeyAnyByte([]byte(",\t;"))
+		for {
+			if _, err := c.Read(p); err == io.EOF {
+				c.Reset()
+			} else if err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Read chunks into a buffer larger than the read ahead size.
+func BenchmarkReadLargeBuffer(b *testing.B) {
+	in := bytes.Repeat(append(bytes.Repeat([]byte("x"), 1000), ';'), 1<<10)
+	p := make([]byte, 1<<16)
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		c := chunkio.NewReader(bytes.NewReader(in))
+		c.SetKey([]byte(";"))
+		c.SetEagerEOF(true)
+		for {
+			if _, err := c.Read(p); err == io.EOF {
+				c.Reset()
+			} else if err != nil {
+				break
+			}
 		}
 	}
 }
@@ -1,3 +1,3 @@
 module git.lenzplace.org/lenzj/chunkio
 
-go 1.12
+go 1.23
@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Jason T. Lenz.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package chunkio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+)
+
+// ChunkScanner provides a convenient interface for reading the chunks of a
+// stream one at a time, in the style of bufio.Scanner.  Successive calls to
+// Scan step through the chunks, which are available from Bytes.
+type ChunkScanner struct {
+	rd   *Reader      // Underlying chunk Reader
+	buf  bytes.Buffer // Current chunk, reused between calls to Scan
+	err  error        // First non-EOF error encountered
+	done bool         // True once the end of the stream is reached
+}
+
+// NewChunkScanner creates a new chunk scanner reading chunks ended by key.
+func NewChunkScanner(rd io.Reader, key []byte) *ChunkScanner {
+	s := &ChunkScanner{rd: NewReader(rd)}
+	s.err = s.rd.SetKey(key)
+	return s
+}
+
+// Scan advances to the next chunk, which is then available through Bytes.  It
+// returns false when the stream is exhausted or an error occurs, after which
+// Err reports the error.  Data at the end of the stream that is not followed
+// by the key is returned as a final chunk.
+func (s *ChunkScanner) Scan() bool {
+	return s.scan(s.rd)
+}
+
+// ScanContext is like Scan but gives up once ctx is done, whether between
+// chunks or while waiting for the data of a chunk, returning false.  Err then
+// returns ctx.Err() and the scan cannot be resumed.  The data is read with
+// Reader.ReadContext, so an abandoned read of the underlying io.Reader keeps
+// running in the background.
+func (s *ChunkScanner) ScanContext(ctx context.Context) bool {
+	if s.err == nil && !s.done {
+		s.err = ctx.Err()
+	}
+	return s.scan(contextReader{s.rd, ctx})
+}
+
+// contextReader reads from a Reader with ReadContext.
+type contextReader struct {
+	rd  *Reader
+	ctx context.Context
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	return r.rd.ReadContext(r.ctx, p)
+}
+
+// scan advances to the next chunk, reading it from rd.
+func (s *ChunkScanner) scan(rd io.Reader) bool {
+	if s.done || s.err != nil {
+		return false
+	}
+	s.buf.Reset()
+	_, err := s.buf.ReadFrom(rd)
+	switch {
+	case err == nil:
+		s.rd.Reset()
+		return true
+	case err == ErrKeyNotFound:
+		s.done = true
+		return s.buf.Len() > 0
+	}
+	s.err = err
+	return false
+}
+
+// Bytes returns the most recent chunk read by Scan.  The underlying array may
+// be overwritten by a later call to Scan.
+func (s *ChunkScanner) Bytes() []byte {
+	return s.buf.Bytes()
+}
+
+// Err returns the first error encountered by the ChunkScanner, or nil if the
+// stream was read to the end.
+func (s *ChunkScanner) Err() error {
+	return s.err
+}
+
+// SplitOnKey returns a bufio.SplitFunc that splits the input into chunks ended
+// by key, with the key discarded, for use with a bufio.Scanner.  As with
+// ChunkScanner, data at the end of the input that is not followed by the key is
+// returned as a final token if it is not empty.  The SplitFunc returns
+// ErrInvalidKey if key is empty.
+func SplitOnKey(key []byte) bufio.SplitFunc {
+	key = append([]byte(nil), key...)
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if err := ValidKey(key); err != nil {
+			return 0, nil, err
+		}
+		if i := bytes.Index(data, key); i >= 0 {
+			return i + len(key), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
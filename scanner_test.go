@@ -0,0 +1,96 @@
+// Copyright (c) 2019 Jason T. Lenz.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package chunkio_test
+
+import (
+	"bufio"
+	"context"
+	"git.lenzplace.org/lenzj/chunkio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scanCases are the chunks expected from splitting a stream on a key, shared by
+// the ChunkScanner and SplitOnKey tests.
+var scanCases = []struct {
+	desc string
+	in   string
+	key  []byte
+	out  []string
+	err  error
+}{
+	{"Trailing key", "a;;b;;", []byte(";;"), []string{"a", "b"}, nil},
+	{"No trailing key", "a;;;;c", []byte(";;"), []string{"a", "", "c"}, nil},
+	{"Empty stream", "", []byte(";;"), nil, nil},
+	{"Invalid key", "a;;b", []byte(""), nil, chunkio.ErrInvalidKey},
+}
+
+func TestShortChunkScanner(t *testing.T) {
+	for _, c := range scanCases {
+		s := chunkio.NewChunkScanner(strings.NewReader(c.in), c.key)
+		var out []string
+		for s.Scan() {
+			out = append(out, string(s.Bytes()))
+		}
+		if s.Err() != c.err {
+			t.Errorf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, c.err, s.Err())
+		}
+		if strings.Join(out, "|") != strings.Join(c.out, "|") || len(out) != len(c.out) {
+			t.Errorf("Case %q. Expected chunks %q, got %q", c.desc, c.out, out)
+		}
+	}
+}
+
+func TestShortScanContext(t *testing.T) {
+	// The stream stalls once the chunks that were read ahead are scanned
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte(strings.Repeat("x;", 5000)))
+	s := chunkio.NewChunkScanner(pr, []byte(";"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	n := 0
+	for s.ScanContext(ctx) {
+		if string(s.Bytes()) != "x" {
+			t.Errorf("ScanContext. Expected chunk %q, got %q", "x", s.Bytes())
+		}
+		n++
+	}
+	if s.Err() != context.DeadlineExceeded {
+		t.Errorf("ScanContext. Expected error=\"%v\", got \"%v\"", context.DeadlineExceeded, s.Err())
+	}
+	if n == 0 || n >= 5000 {
+		t.Errorf("ScanContext. Expected some of the chunks before cancellation, got %d", n)
+	}
+	if s.Scan() {
+		t.Errorf("Scan. Expected false after cancellation, got true")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	s = chunkio.NewChunkScanner(strings.NewReader("a;b"), []byte(";"))
+	if s.ScanContext(ctx) || s.Err() != context.Canceled {
+		t.Errorf("ScanContext. Expected error=\"%v\", got \"%v\"", context.Canceled, s.Err())
+	}
+}
+
+func TestShortSplitOnKey(t *testing.T) {
+	for _, c := range scanCases {
+		s := bufio.NewScanner(strings.NewReader(c.in))
+		s.Split(chunkio.SplitOnKey(c.key))
+		var out []string
+		for s.Scan() {
+			out = append(out, s.Text())
+		}
+		if s.Err() != c.err {
+			t.Errorf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, c.err, s.Err())
+		}
+		if strings.Join(out, "|") != strings.Join(c.out, "|") || len(out) != len(c.out) {
+			t.Errorf("Case %q. Expected chunks %q, got %q", c.desc, c.out, out)
+		}
+	}
+}
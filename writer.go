@@ -0,0 +1,240 @@
+// Copyright (c) 2019 Jason T. Lenz.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package chunkio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+var ErrKeyInChunk = errors.New("chunkio: key found in chunk data")
+
+// Writer implements the counterpart of Reader, writing chunks to an io.Writer
+// each followed by a key so the output can be read back with a Reader using the
+// same key.
+type Writer struct {
+	out   io.Writer     // Underlying Writer
+	wr    *bufio.Writer // Buffered underlying Writer
+	key   []byte        // key that delineates end of chunk
+	esc   []byte        // Escape sequence used to encode chunk data; nil if none
+	flush bool          // True if the underlying Writer is flushed after each chunk
+	err   error         // Sticky error state of chunkio Writer
+}
+
+// NewWriter creates a new chunk writer that ends each chunk with key.
+func NewWriter(w io.Writer, key []byte) *Writer {
+	c := &Writer{
+		out: w,
+		wr:  bufio.NewWriter(w),
+		key: key,
+		err: nil,
+	}
+	c.err = ValidKey(key)
+	return c
+}
+
+// SetEscape makes chunks containing the key writable by encoding the chunk data
+// with the escape sequence esc.  Every byte of the data equal to the first byte
+// of the key or of esc is written as esc followed by the byte XORed with 0x20,
+// so the key cannot appear in the encoded data.  A Reader decodes the chunks
+// after SetUnescape with the same esc.  The first byte of the key must not
+// appear in esc or be the first byte of esc XORed with 0x20, and esc must be
+// shorter than 16 bytes, otherwise ErrInvalidEscape is returned.  A nil esc
+// turns encoding off, which is the default.
+func (w *Writer) SetEscape(esc []byte) error {
+	if esc == nil {
+		w.esc = nil
+		return nil
+	}
+	if len(esc) == 0 || len(esc) >= minBufAdd {
+		return ErrInvalidEscape
+	}
+	if len(w.key) > 0 && (bytes.IndexByte(esc, w.key[0]) >= 0 || esc[0]^escXor == w.key[0]) {
+		return ErrInvalidEscape
+	}
+	w.esc = append([]byte(nil), esc...)
+	return nil
+}
+
+// SetFlushOnChunk controls whether each chunk written is flushed to the
+// underlying io.Writer together with its key.  If the underlying io.Writer has
+// a Flush method returning an error, as compress/flate.Writer and gzip.Writer
+// do, it is called as well, so that each chunk can be decoded as soon as it is
+// received.  By default data is only flushed when the buffer is full or on
+// Close.
+func (w *Writer) SetFlushOnChunk(flush bool) {
+	w.flush = flush
+}
+
+// WriteChunk writes p as a chunk followed by the key.  It returns the number
+// of bytes of p written.  Since the key ends the chunk, p must not contain the
+// key, including a key that would start in p and end in the key written after
+// it.  Such a chunk is rejected with ErrKeyInChunk and nothing is written,
+// unless an escape sequence is set with SetEscape.  An empty chunk is written
+// as just the key.
+func (w *Writer) WriteChunk(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	var err error
+	if w.esc != nil {
+		n, err = w.escape(p)
+	} else if !w.valid(p) {
+		return 0, ErrKeyInChunk
+	} else {
+		n, err = w.wr.Write(p)
+	}
+	return n, w.end(err)
+}
+
+// WriteString is like WriteChunk but writes the contents of s as the chunk,
+// without converting it to a byte slice.  It implements io.StringWriter.
+func (w *Writer) WriteString(s string) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	var err error
+	if w.esc != nil {
+		n, err = w.escapeString(s)
+	} else if !w.validString(s) {
+		return 0, ErrKeyInChunk
+	} else {
+		n, err = w.wr.WriteString(s)
+	}
+	return n, w.end(err)
+}
+
+// end writes the key after the chunk unless writing it failed with err,
+// flushes the chunk if needed and records any error.
+func (w *Writer) end(err error) error {
+	if err == nil {
+		_, err = w.wr.Write(w.key)
+	}
+	if err == nil && w.flush {
+		err = w.flushAll()
+	}
+	w.err = err
+	return err
+}
+
+// flushAll flushes the buffered data and then the underlying io.Writer if it
+// has a Flush method.
+func (w *Writer) flushAll() error {
+	if err := w.wr.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.out.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// escape returns p encoded with the escape sequence esc for a key starting with
+// the byte key0, as written by a Writer after SetEscape.
+func escape(p, esc []byte, key0 byte) []byte {
+	var b []byte
+	for _, c := range p {
+		if c == key0 || c == esc[0] {
+			b = append(append(b, esc...), c^escXor)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// escape writes p encoded with the escape sequence.
+func (w *Writer) escape(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		i := n
+		for i < len(p) && p[i] != w.key[0] && p[i] != w.esc[0] {
+			i++
+		}
+		if _, err := w.wr.Write(p[n:i]); err != nil {
+			return n, err
+		}
+		n = i
+		if n == len(p) {
+			break
+		}
+		if _, err := w.wr.Write(w.esc); err != nil {
+			return n, err
+		}
+		if err := w.wr.WriteByte(p[n] ^ escXor); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// escapeString is escape for a string.
+func (w *Writer) escapeString(s string) (int, error) {
+	n := 0
+	for n < len(s) {
+		i := n
+		for i < len(s) && s[i] != w.key[0] && s[i] != w.esc[0] {
+			i++
+		}
+		if _, err := w.wr.WriteString(s[n:i]); err != nil {
+			return n, err
+		}
+		n = i
+		if n == len(s) {
+			break
+		}
+		if _, err := w.wr.Write(w.esc); err != nil {
+			return n, err
+		}
+		if err := w.wr.WriteByte(s[n] ^ escXor); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// valid reports whether the first instance of the key in p followed by the key
+// is the key written after p.
+func (w *Writer) valid(p []byte) bool {
+	if bytes.Contains(p, w.key) {
+		return false
+	}
+	// Only the last len(key)-1 bytes of p can combine with the key
+	t := p
+	if len(t) >= len(w.key) {
+		t = t[len(t)-len(w.key)+1:]
+	}
+	b := make([]byte, 0, len(t)+len(w.key))
+	b = append(append(b, t...), w.key...)
+	return bytes.Index(b, w.key) == len(t)
+}
+
+// validString is valid for a string.
+func (w *Writer) validString(s string) bool {
+	if strings.Contains(s, string(w.key)) {
+		return false
+	}
+	if len(s) >= len(w.key) {
+		s = s[len(s)-len(w.key)+1:]
+	}
+	return w.valid([]byte(s))
+}
+
+// Close flushes any buffered data to the underlying io.Writer.  It does not
+// close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.wr.Flush()
+	return w.err
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2019 Jason T. Lenz.  All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package chunkio_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"git.lenzplace.org/lenzj/chunkio"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestShortWriteChunk(t *testing.T) {
+	cases := []struct {
+		desc  string
+		key   []byte
+		chunk []byte
+		err   error
+	}{
+		{desc: "Plain chunk", key: []byte(";;"), chunk: []byte("abc")},
+		{desc: "Empty chunk", key: []byte(";;"), chunk: []byte("")},
+		{desc: "Key inside chunk", key: []byte(";;"), chunk: []byte("a;;b"), err: chunkio.ErrKeyInChunk},
+		{desc: "Key across chunk end", key: []byte("aa"), chunk: []byte("xa"), err: chunkio.ErrKeyInChunk},
+		{desc: "Partial key at chunk end", key: []byte("ab"), chunk: []byte("xa")},
+	}
+	for _, c := range cases {
+		var b bytes.Buffer
+		w := chunkio.NewWriter(&b, c.key)
+		n, err := w.WriteChunk(c.chunk)
+		if err != c.err {
+			t.Errorf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, c.err, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("Case %q. Expected close error=\"%v\", got \"%v\"", c.desc, nil, err)
+		}
+		if c.err != nil {
+			continue
+		}
+		if n != len(c.chunk) {
+			t.Errorf("Case %q. Expected %d bytes written, got %d", c.desc, len(c.chunk), n)
+		}
+		r := chunkio.NewReader(&b)
+		r.SetKey(c.key)
+		out, err := r.ReadChunk()
+		if err != nil || bytes.Compare(out, c.chunk) != 0 {
+			t.Errorf("Case %q. Expected round trip %q, got %q (err %v)", c.desc, c.chunk, out, err)
+		}
+		r.Reset()
+		if _, err := r.ReadChunk(); err != chunkio.ErrKeyNotFound {
+			t.Errorf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, chunkio.ErrKeyNotFound, err)
+		}
+	}
+}
+
+func TestShortWriteString(t *testing.T) {
+	var _ io.StringWriter = (*chunkio.Writer)(nil)
+	for _, esc := range [][]byte{nil, []byte("\\")} {
+		var want, got bytes.Buffer
+		ww := chunkio.NewWriter(&want, []byte(";;"))
+		wg := chunkio.NewWriter(&got, []byte(";;"))
+		ww.SetEscape(esc)
+		wg.SetEscape(esc)
+		for _, chunk := range []string{"abc", "", "a;b\\", "a;;b", "x;"} {
+			n1, err1 := ww.WriteChunk([]byte(chunk))
+			n2, err2 := wg.WriteString(chunk)
+			if n1 != n2 || err1 != err2 {
+				t.Errorf("WriteString(%q). Expected %d bytes (err %v), got %d (err %v)", chunk, n1, err1, n2, err2)
+			}
+		}
+		ww.Close()
+		wg.Close()
+		if want.String() != got.String() {
+			t.Errorf("WriteString. Expected output %q, got %q", want.String(), got.String())
+		}
+	}
+	w := chunkio.NewWriter(io.Discard, []byte(";;"))
+	if n := testing.AllocsPerRun(100, func() { w.WriteString("abcdef") }); n != 0 {
+		t.Errorf("WriteString. Expected %d allocations, got %v", 0, n)
+	}
+}
+
+func TestShortEscape(t *testing.T) {
+	cases := []struct {
+		desc   string
+		key    []byte
+		esc    []byte
+		chunks []string
+	}{
+		{"Key inside chunk", []byte(";"), []byte("\\"), []string{"a;b", ";", ";;", "", "c"}},
+		{"Key at chunk end", []byte(";;"), []byte("\\"), []string{"ab;", ";ab", "a;;b;;"}},
+		{"Escape bytes", []byte(";"), []byte("\\"), []string{"\\", "\\;\\", "\\|", "|\\|"}},
+		{"Long escape", []byte("END"), []byte("%%"), []string{"%%ENDEND%", "E%", strings.Repeat("END%%", 20)}},
+	}
+	for _, c := range cases {
+		var b bytes.Buffer
+		w := chunkio.NewWriter(&b, c.key)
+		if err := w.SetEscape(c.esc); err != nil {
+			t.Fatalf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, nil, err)
+		}
+		for _, chunk := range c.chunks {
+			if n, err := w.WriteChunk([]byte(chunk)); err != nil || n != len(chunk) {
+				t.Errorf("Case %q. Expected %d bytes written, got %d (err %v)", c.desc, len(chunk), n, err)
+			}
+		}
+		w.Close()
+		for _, size := range []int{16, 4096} {
+			r := chunkio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(b.Bytes())), size)
+			r.SetKey(c.key)
+			r.SetUnescape(c.esc)
+			var out []string
+			for chunk, err := range r.Chunks() {
+				if err != nil {
+					t.Errorf("Case %q. Expected error=\"%v\", got \"%v\"", c.desc, nil, err)
+				}
+				out = append(out, string(chunk))
+			}
+			if strings.Join(out, "|") != strings.Join(c.chunks, "|") || len(out) != len(c.chunks) {
+				t.Errorf("Case %q. Expected chunks %q, got %q", c.desc, c.chunks, out)
+			}
+		}
+		r := chunkio.NewReader(bytes.NewReader(b.Bytes()))
+		r.SetKey(c.key)
+		r.SetUnescape(c.esc)
+		var sb strings.Builder
+		for {
+			ch, _, err := r.ReadRune()
+			if err != nil {
+				break
+			}
+			sb.WriteRune(ch)
+		}
+		if sb.String() != c.chunks[0] {
+			t.Errorf("Case %q. Expected ReadRune %q, got %q", c.desc, c.chunks[0], sb.String())
+		}
+	}
+	if err := chunkio.NewWriter(nil, []byte(";")).SetEscape([]byte("a;")); err != chunkio.ErrInvalidEscape {
+		t.Errorf("SetEscape. Expected error=\"%v\", got \"%v\"", chunkio.ErrInvalidEscape, err)
+	}
+}
+
+// flushBuffer is a bytes.Buffer counting calls to Flush.
+type flushBuffer struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (b *flushBuffer) Flush() error {
+	b.flushes++
+	return nil
+}
+
+func TestShortSetFlushOnChunk(t *testing.T) {
+	var b flushBuffer
+	w := chunkio.NewWriter(&b, []byte(";"))
+	w.WriteChunk([]byte("abc"))
+	if b.Len() != 0 || b.flushes != 0 {
+		t.Errorf("WriteChunk. Expected %q and %d flushes, got %q and %d", "", 0, b.String(), b.flushes)
+	}
+	w.SetFlushOnChunk(true)
+	w.WriteChunk([]byte("de"))
+	if b.String() != "abc;de;" || b.flushes != 1 {
+		t.Errorf("WriteChunk. Expected %q and %d flushes, got %q and %d", "abc;de;", 1, b.String(), b.flushes)
+	}
+
+	// Each chunk can be decompressed as soon as it is written
+	var z bytes.Buffer
+	fw, _ := flate.NewWriter(&z, flate.BestSpeed)
+	w = chunkio.NewWriter(fw, []byte(";"))
+	w.SetFlushOnChunk(true)
+	want := ""
+	for _, chunk := range []string{"abc", "", "defg"} {
+		w.WriteChunk([]byte(chunk))
+		want += chunk + ";"
+		out := make([]byte, len(want))
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(z.Bytes())), out); err != nil || string(out) != want {
+			t.Errorf("Decompress. Expected %q (err %v), got %q (err %v)", want, nil, out, err)
+		}
+	}
+}